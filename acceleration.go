@@ -35,7 +35,7 @@ func (acc Acceleration) TwoSidedLeaf(t *Tree, i int) {
 }
 
 func (acc Acceleration) Approximate(t1, t2 *Tree, i1, i2 int) {
-	switch t2.Order {
+	switch order := t1.approximationOrder(t2, i1, i2); order {
 	case Monopole:
 		node_i2, node_i1 := &t2.Nodes[i2], &t1.Nodes[i1]
 		x_i1 := &node_i1.Center
@@ -57,10 +57,41 @@ func (acc Acceleration) Approximate(t1, t2 *Tree, i1, i2 int) {
 			}
 		}
 	case Quadrupole:
-		// TODO: Implement (Plummer) quadrupole appoximation of acceleration
-		panic("NYI")
+		// Plummer-softened quadrupole approximation: the gradient of the
+		// potential in Potential.Approximate,
+		// a = M d h1 + (tr(Q) d h2 + 2 Q.d h2 + d.Q.d d h3)/2.
+		node_i2, node_i1 := &t2.Nodes[i2], &t1.Nodes[i1]
+		x_i1 := &node_i1.Center
+		mass_i1 := float64(node_i1.End - node_i1.Start)
+		q := &t1.Q[i1]
+		trQ := t1.P[i1][0] + t1.P[i1][1] + t1.P[i1][2]
+
+		for i2 := node_i2.Start; i2 < node_i2.End; i2++ {
+			x_i2, idx_i2 := &t2.Points[i2], t2.Index[i2]
+
+			d := [3]float64{ x_i2[0] - x_i1[0], x_i2[1] - x_i1[1],
+				x_i2[2] - x_i1[2] }
+			r2 := d[0]*d[0] + d[1]*d[1] + d[2]*d[2] + t1.eps2
+			f := 1 / math.Sqrt(r2)
+			h1 := -f / r2
+			h2 := -3 * h1 / r2
+			h3 := -5 * h2 / r2
+
+			dQd := quadForm(q, &d)
+			for k := 0; k < 3; k++ {
+				qd := q[k][0]*d[0] + q[k][1]*d[1] + q[k][2]*d[2]
+				acc[idx_i2][k] += mass_i1*d[k]*h1 +
+					(trQ*d[k]*h2 + 2*qd*h2 + dQd*d[k]*h3)/2
+			}
+		}
+	case Octupole, Hexadecapole:
+		node_i2 := &t2.Nodes[i2]
+		k := newMultipoleKernel(t1, i1, order)
+		for i2 := node_i2.Start; i2 < node_i2.End; i2++ {
+			k.acceleration(&t2.Points[i2], &acc[t2.Index[i2]])
+		}
 	default:
-		panic(fmt.Sprintf("Unrecognized approximaiton order code, %d", t2.Order))
+		panic(fmt.Sprintf("Unrecognized approximaiton order code, %d", order))
 	}
 }
 
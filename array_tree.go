@@ -33,6 +33,7 @@ func NewArrayTree(x [][3]float64) *ArrayTree {
 	for i := range nodes {
 		nodes[i].Start, nodes[i].End = i, i+1
 		nodes[i].Left, nodes[i].Center = -1, x[i]
+		nodes[i].Span = [2][3]float64{ x[i], x[i] }
 	}
 	return  &ArrayTree{ Tree{ Points: x, Index: idx, Nodes: nodes } }
 }
@@ -42,6 +43,7 @@ func NewArrayTree(x [][3]float64) *ArrayTree {
 func (t *ArrayTree) Update() {
 	for i := range t.Nodes {
 		t.Nodes[i].Center = t.Points[i]
+		t.Nodes[i].Span = [2][3]float64{ t.Points[i], t.Points[i] }
 	}
 }
 
@@ -0,0 +1,119 @@
+package gravitree
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// ErrorPercentiles summarizes the relative errors of a tree result at a
+// random subsample of points, compared against brute force.
+type ErrorPercentiles struct {
+	Median, P99, Max float64
+	Samples int // The number of points that were checked.
+}
+
+// String returns a printable summary of the errors.
+func (e ErrorPercentiles) String() string {
+	return fmt.Sprintf("relative error: median %.3g, 99%% %.3g, max %.3g " +
+		"(%d samples)", e.Median, e.P99, e.Max, e.Samples)
+}
+
+// AuditPotential compares the potentials, phi, computed with t.Evaluate(eps,
+// phi) against exact values at a random subsample of points and returns
+// the percentiles of the relative errors. samples is the number of points to
+// check and must be positive, and seed is the random seed used to choose them. This costs
+// O(samples * len(t.Points)) operations, so it can be run alongside
+// production calculations to log their actual accuracy.
+func (t *Tree) AuditPotential(
+	eps float64, phi Potential, samples int, seed int64,
+) ErrorPercentiles {
+	idx, pos := t.auditSample(len(phi), samples, seed)
+	err := make([]float64, len(idx))
+
+	WorkerQueue(nWorkers, len(idx), func(worker, i int) {
+		exact := make([]float64, 1)
+		target := t.Points[pos[i]: pos[i] + 1]
+		BruteForcePotentialAt(eps, t.Points[:pos[i]], target, exact)
+		BruteForcePotentialAt(eps, t.Points[pos[i] + 1:], target, exact)
+
+		err[i] = math.Abs(phi[idx[i]] - exact[0]) / math.Abs(exact[0])
+	})
+
+	return errorPercentiles(err)
+}
+
+// AuditAcceleration compares the accelerations, acc, computed with
+// t.Evaluate(eps, acc) against exact values at a random subsample of points
+// and returns the percentiles of the relative errors in the acceleration
+// vectors. See AuditPotential.
+func (t *Tree) AuditAcceleration(
+	eps float64, acc Acceleration, samples int, seed int64,
+) ErrorPercentiles {
+	idx, pos := t.auditSample(len(acc), samples, seed)
+	err := make([]float64, len(idx))
+
+	WorkerQueue(nWorkers, len(idx), func(worker, i int) {
+		exact := make([][3]float64, 1)
+		target := t.Points[pos[i]: pos[i] + 1]
+		BruteForceAccelerationAt(eps, t.Points[:pos[i]], target, exact)
+		BruteForceAccelerationAt(eps, t.Points[pos[i] + 1:], target, exact)
+
+		dx2, x2 := 0.0, 0.0
+		for k := 0; k < 3; k++ {
+			dx := acc[idx[i]][k] - exact[0][k]
+			dx2 += dx*dx
+			x2 += exact[0][k]*exact[0][k]
+		}
+		err[i] = math.Sqrt(dx2 / x2)
+	})
+
+	return errorPercentiles(err)
+}
+
+// auditSample chooses up to samples random points from the tree. It returns
+// their original indices and their positions in t.Points.
+func (t *Tree) auditSample(n, samples int, seed int64) (idx, pos []int) {
+	if n != len(t.Points) {
+		panic(fmt.Sprintf("Tree has %d points, but len(q) = %d",
+			len(t.Points), n))
+	} else if samples <= 0 {
+		panic(fmt.Sprintf("samples must be positive, got %d.", samples))
+	}
+	if samples > n { samples = n }
+
+	idx = rand.New(rand.NewSource(seed)).Perm(n)[:samples]
+	sort.Ints(idx)
+
+	sampleIdx := make(map[int]int, samples)
+	for i := range idx { sampleIdx[idx[i]] = i }
+	pos = make([]int, samples)
+	for k := range t.Index {
+		if i, ok := sampleIdx[t.Index[k]]; ok { pos[i] = k }
+	}
+
+	return idx, pos
+}
+
+// errorPercentiles computes the percentiles of err. err is sorted in place.
+func errorPercentiles(err []float64) ErrorPercentiles {
+	if len(err) == 0 { return ErrorPercentiles{ } }
+
+	sort.Float64s(err)
+	return ErrorPercentiles{
+		Median: percentile(err, 0.5),
+		P99: percentile(err, 0.99),
+		Max: err[len(err) - 1],
+		Samples: len(err),
+	}
+}
+
+// percentile returns the q-th quantile of the sorted array x, linearly
+// interpolating between elements.
+func percentile(x []float64, q float64) float64 {
+	f := q * float64(len(x) - 1)
+	i := int(f)
+	if i >= len(x) - 1 { return x[len(x) - 1] }
+	return x[i] + (f - float64(i))*(x[i+1] - x[i])
+}
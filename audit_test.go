@@ -0,0 +1,78 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestPercentile(t *testing.T) {
+	x := []float64{0, 1, 2, 3, 4}
+	tests := []struct {
+		q, val float64
+	}{
+		{0, 0}, {0.5, 2}, {0.99, 3.96}, {1, 4}, {0.125, 0.5},
+	}
+
+	for i := range tests {
+		val := percentile(x, tests[i].q)
+		if !almostEq(val, tests[i].val, 1e-9) {
+			t.Errorf("%d) Expected percentile(%.0f, %g) = %g, got %g.",
+				i, x, tests[i].q, tests[i].val, val)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	rand.Seed(7)
+	x := randomPoints(1000)
+	tree := NewTree(x)
+	eps := 0.01
+
+	phi := make([]float64, len(x))
+	tree.Evaluate(eps, Potential(phi))
+	acc := make([][3]float64, len(x))
+	tree.Evaluate(eps, Acceleration(acc))
+
+	phiBrute := make([]float64, len(x))
+	BruteForcePotential(eps, x, phiBrute)
+	accBrute := make([][3]float64, len(x))
+	BruteForceAcceleration(eps, x, accBrute)
+
+	maxPhiErr, maxAccErr := 0.0, 0.0
+	for i := range x {
+		phiErr := math.Abs(phi[i] - phiBrute[i]) / math.Abs(phiBrute[i])
+		maxPhiErr = math.Max(maxPhiErr, phiErr)
+
+		dx2, x2 := 0.0, 0.0
+		for k := 0; k < 3; k++ {
+			dx := acc[i][k] - accBrute[i][k]
+			dx2 += dx*dx
+			x2 += accBrute[i][k]*accBrute[i][k]
+		}
+		maxAccErr = math.Max(maxAccErr, math.Sqrt(dx2/x2))
+	}
+
+	// Sampling every point should reproduce the full error distribution.
+	phiAudit := tree.AuditPotential(eps, phi, len(x), 0)
+	accAudit := tree.AuditAcceleration(eps, acc, 2*len(x), 0)
+
+	if phiAudit.Samples != len(x) || accAudit.Samples != len(x) {
+		t.Errorf("Expected %d samples, got %d and %d.", len(x),
+			phiAudit.Samples, accAudit.Samples)
+	}
+	if !almostEq(phiAudit.Max, maxPhiErr, 1e-9) {
+		t.Errorf("Expected max potential error %g, got %g.",
+			maxPhiErr, phiAudit.Max)
+	}
+	if !almostEq(accAudit.Max, maxAccErr, 1e-9) {
+		t.Errorf("Expected max acceleration error %g, got %g.",
+			maxAccErr, accAudit.Max)
+	}
+
+	sub := tree.AuditAcceleration(eps, acc, 100, 1)
+	if sub.Samples != 100 || sub.Median > sub.P99 || sub.P99 > sub.Max ||
+		sub.Max > maxAccErr {
+		t.Errorf("Inconsistent subsample audit: %s", sub)
+	}
+}
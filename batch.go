@@ -0,0 +1,78 @@
+package gravitree
+
+import (
+	"fmt"
+)
+
+// BatchEvaluate builds a Tree for each of the point sets in x and evaluates
+// q[i] on the i-th tree with the softening scale eps. This is intended for
+// large catalogs of small halos: rather than parallelizing over the leaves of
+// a single tree, each worker builds and evaluates one halo at a time. Each
+// worker keeps its own TreeOptions pool, so the buffers of one halo's tree are
+// reused for the next halo that the worker handles.
+//
+// Only the first TreeOptions argument is used. Any buffers it contains are
+// ignored, since they can't be shared between workers.
+func BatchEvaluate(x [][][3]float64, eps float64, q []Quantity,
+	opt ...TreeOptions) {
+	if len(x) != len(q) {
+		panic(fmt.Sprintf("len(x) = %d, but len(q) = %d", len(x), len(q)))
+	}
+
+	pool := newTreePool(nWorkers, opt...)
+	WorkerQueue(nWorkers, len(x), func(worker, i int) {
+		t := NewTree(x[i], pool[worker])
+		evaluate(t, 1, eps, q[i])
+		pool[worker] = t.Reuse()
+	})
+}
+
+// BatchPotential computes the potential of every point in each of the point
+// sets in x using BatchEvaluate. The potential of x[i][j] is returned in
+// phi[i][j].
+func BatchPotential(x [][][3]float64, eps float64,
+	opt ...TreeOptions) (phi [][]float64) {
+	phi = make([][]float64, len(x))
+	q := make([]Quantity, len(x))
+	for i := range x {
+		phi[i] = make([]float64, len(x[i]))
+		q[i] = Potential(phi[i])
+	}
+
+	BatchEvaluate(x, eps, q, opt...)
+	return phi
+}
+
+// BatchAcceleration computes the acceleration of every point in each of the
+// point sets in x using BatchEvaluate. The acceleration of x[i][j] is
+// returned in acc[i][j].
+func BatchAcceleration(x [][][3]float64, eps float64,
+	opt ...TreeOptions) (acc [][][3]float64) {
+	acc = make([][][3]float64, len(x))
+	q := make([]Quantity, len(x))
+	for i := range x {
+		acc[i] = make([][3]float64, len(x[i]))
+		q[i] = Acceleration(acc[i])
+	}
+
+	BatchEvaluate(x, eps, q, opt...)
+	return acc
+}
+
+// newTreePool returns one TreeOptions for each worker. Each has the
+// configuration of opt[0] (if it exists) and no buffers.
+func newTreePool(workers int, opt ...TreeOptions) []TreeOptions {
+	base := TreeOptions{ }
+	if len(opt) > 0 {
+		base = TreeOptions{
+			LeafSize: opt[0].LeafSize,
+			Criteria: opt[0].Criteria,
+			Theta: opt[0].Theta,
+			Order: opt[0].Order,
+		}
+	}
+
+	pool := make([]TreeOptions, workers)
+	for i := range pool { pool[i] = base }
+	return pool
+}
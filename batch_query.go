@@ -0,0 +1,135 @@
+package gravitree
+
+import (
+	"fmt"
+)
+
+// batchQueryChunk is the number of queries that a worker takes from the
+// queue at once.
+const batchQueryChunk = 64
+
+// Neighbors holds the results of a batch neighbor query in a flattened form.
+// The neighbors of query i are Index[Offsets[i]: Offsets[i+1]]. For kNN
+// queries, their squared distances are the same range of R2. Sphere queries
+// leave R2 empty, like SearchSphere. A Neighbors can be passed back into the
+// next batch query to reuse its arrays and its per-worker buffers.
+type Neighbors struct {
+	Offsets []int // len(Offsets) = number of queries + 1
+	Index []int // Original indices of the neighbors.
+	R2 []float64 // Squared distances to the neighbors (kNN only).
+
+	worker []int // The worker that ran each query.
+	start []int // The start of each query's results in its worker's buffer.
+	spheres [][]int // Per-worker sphere search results.
+	knn []*KNearestBuffer // Per-worker kNN queues.
+}
+
+// Of returns the original indices of the neighbors of query i.
+func (n *Neighbors) Of(i int) []int {
+	return n.Index[n.Offsets[i]: n.Offsets[i+1]]
+}
+
+// BatchSearchSphere runs SearchSphere on every point in x with the
+// corresponding radius in r and returns the results in a Neighbors. The
+// queries are split across workers. An optional Neighbors from a previous
+// query can be passed to reduce allocations.
+func (t *Tree) BatchSearchSphere(
+	x [][3]float64, r []float64, buf ...*Neighbors,
+) *Neighbors {
+	return batchSearchSphere(t.spatialIndex(), x, r, buf...)
+}
+
+// BatchKNearest runs KNearest on every point in x and returns the results in
+// a Neighbors. Each query has min(k, len(t.Points)) neighbors. The queries
+// are split across workers. An optional Neighbors from a previous query can
+// be passed to reduce allocations.
+func (t *Tree) BatchKNearest(
+	x [][3]float64, k int, buf ...*Neighbors,
+) *Neighbors {
+	return batchKNearest(t.spatialIndex(), x, k, buf...)
+}
+
+// batchSearchSphere is the same as BatchSearchSphere, except that it walks
+// any SpatialIndex.
+func batchSearchSphere(
+	idx SpatialIndex, x [][3]float64, r []float64, buf ...*Neighbors,
+) *Neighbors {
+	if len(x) != len(r) {
+		panic(fmt.Sprintf("len(x) = %d, but len(r) = %d", len(x), len(r)))
+	}
+	nb := newNeighbors(len(x), buf...)
+	for len(nb.spheres) < nWorkers { nb.spheres = append(nb.spheres, nil) }
+	for w := range nb.spheres { nb.spheres[w] = nb.spheres[w][:0] }
+
+	t := idx.Base()
+	if len(t.Nodes) == 0 {
+		nb.Index, nb.R2 = nb.Index[:0], nb.R2[:0]
+		return nb
+	}
+
+	runBatchQueries(len(x), func(worker, i int) {
+		out := nb.spheres[worker]
+		nb.worker[i], nb.start[i] = worker, len(out)
+		out = walkTreeSearchSphere(idx, t, 0, x[i], r[i], out)
+		nb.Offsets[i + 1] = len(out) - nb.start[i]
+		nb.spheres[worker] = out
+	})
+
+	// Offsets hold counts until now.
+	for i := range x { nb.Offsets[i + 1] += nb.Offsets[i] }
+	n := nb.Offsets[len(x)]
+	nb.Index = append(nb.Index[:0], make([]int, n)...)
+	nb.R2 = nb.R2[:0]
+
+	runBatchQueries(len(x), func(worker, i int) {
+		start, end := nb.Offsets[i], nb.Offsets[i + 1]
+		copy(nb.Index[start: end], nb.spheres[nb.worker[i]][nb.start[i]:])
+	})
+
+	return nb
+}
+
+// batchKNearest is the same as BatchKNearest, except that it walks any
+// SpatialIndex.
+func batchKNearest(
+	idx SpatialIndex, x [][3]float64, k int, buf ...*Neighbors,
+) *Neighbors {
+	nb := newNeighbors(len(x), buf...)
+	for len(nb.knn) < nWorkers { nb.knn = append(nb.knn, &KNearestBuffer{ }) }
+
+	t := idx.Base()
+	if k > len(t.Points) { k = len(t.Points) }
+	if k < 0 { k = 0 }
+	for i := range nb.Offsets { nb.Offsets[i] = i*k }
+	nb.Index = append(nb.Index[:0], make([]int, k*len(x))...)
+	nb.R2 = append(nb.R2[:0], make([]float64, k*len(x))...)
+
+	runBatchQueries(len(x), func(worker, i int) {
+		found, r2 := kNearest(idx, x[i], k, nb.knn[worker])
+		copy(nb.Index[i*k: (i+1)*k], found)
+		copy(nb.R2[i*k: (i+1)*k], r2)
+	})
+
+	return nb
+}
+
+// newNeighbors returns a Neighbors for n queries, reusing buf if it's given.
+func newNeighbors(n int, buf ...*Neighbors) *Neighbors {
+	nb := &Neighbors{ }
+	if len(buf) > 0 && buf[0] != nil { nb = buf[0] }
+	nb.Offsets = append(nb.Offsets[:0], make([]int, n + 1)...)
+	nb.worker = append(nb.worker[:0], make([]int, n)...)
+	nb.start = append(nb.start[:0], make([]int, n)...)
+	return nb
+}
+
+// runBatchQueries calls query on every query index in [0, n), splitting the
+// queries into chunks that are run by nWorkers workers.
+func runBatchQueries(n int, query func(worker, i int)) {
+	chunks := (n + batchQueryChunk - 1) / batchQueryChunk
+	WorkerQueue(nWorkers, chunks, func(worker, chunk int) {
+		end := (chunk + 1)*batchQueryChunk
+		if end > n { end = n }
+		for i := chunk*batchQueryChunk; i < end; i++ { query(worker, i) }
+	})
+}
@@ -0,0 +1,79 @@
+package gravitree
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestBatchQueries(t *testing.T) {
+	rand.Seed(21)
+	x := normalPoints(3000)
+	tree := NewTree(x)
+
+	q := normalPoints(1000)
+	r := make([]float64, len(q))
+	for i := range r { r[i] = 0.5*rand.Float64() }
+
+	var sphere, knn *Neighbors
+	for ti, bt := range []*Tree{ tree, &NewOctree(x).Tree } {
+		// Reusing the previous results shouldn't change anything.
+		for rep := 0; rep < 2; rep++ {
+			sphere = bt.BatchSearchSphere(q, r, sphere)
+			knn = bt.BatchKNearest(q, 12, knn)
+
+			if len(sphere.Offsets) != len(q) + 1 ||
+				sphere.Offsets[len(q)] != len(sphere.Index) {
+				t.Fatalf("Sphere offsets are inconsistent.")
+			}
+
+			for i := range q {
+				found := append([]int{ }, sphere.Of(i)...)
+				exp := tree.SearchSphere(q[i], r[i])
+				sort.Ints(found)
+				sort.Ints(exp)
+				if !intsEqual(found, exp) {
+					t.Fatalf("Tree %d query %d found %v, expected %v.",
+						ti, i, found, exp)
+				}
+
+				expIdx, expR2 := tree.KNearest(q[i], 12)
+				start, end := knn.Offsets[i], knn.Offsets[i + 1]
+				if end - start != 12 {
+					t.Fatalf("kNN query %d has %d neighbors.", i, end - start)
+				}
+				for j := start; j < end; j++ {
+					if knn.Index[j] != expIdx[j - start] ||
+						knn.R2[j] != expR2[j - start] {
+						t.Fatalf("Tree %d kNN query %d found %v, expected %v.",
+							ti, i, knn.Of(i), expIdx)
+					}
+				}
+			}
+		}
+	}
+
+	// k larger than the number of points returns every point.
+	knn = tree.BatchKNearest(q[:3], len(x) + 5)
+	if knn.Offsets[3] != 3*len(x) {
+		t.Errorf("Expected %d kNN results, got %d.", 3*len(x), knn.Offsets[3])
+	}
+
+	// Trees without points find nothing.
+	empty := NewTree(nil)
+	sphere = empty.BatchSearchSphere(q, r)
+	if sphere.Offsets[len(q)] != 0 || len(sphere.Index) != 0 {
+		t.Errorf("Empty tree found %d points.", len(sphere.Index))
+	}
+	if found := empty.SearchSphere(q[0], 10); len(found) != 0 {
+		t.Errorf("Empty tree found %v.", found)
+	}
+}
+
+func intsEqual(x, y []int) bool {
+	if len(x) != len(y) { return false }
+	for i := range x {
+		if x[i] != y[i] { return false }
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package gravitree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func randomHalos(sizes []int) [][][3]float64 {
+	x := make([][][3]float64, len(sizes))
+	for i := range x {
+		x[i] = make([][3]float64, sizes[i])
+		for j := range x[i] {
+			for k := 0; k < 3; k++ {
+				x[i][j][k] = rand.Float64()
+			}
+		}
+	}
+	return x
+}
+
+func TestBatchEvaluate(t *testing.T) {
+	rand.Seed(0)
+
+	sizes := []int{0, 1, 10, 100, 500, 1000, 17, 300, 2000, 64}
+	x := randomHalos(sizes)
+	opt := TreeOptions{ LeafSize: 8, Theta: 0.5 }
+
+	phi := BatchPotential(x, 0.01, opt)
+	acc := BatchAcceleration(x, 0.01, opt)
+
+	for i := range x {
+		tree := NewTree(x[i], opt)
+		phi0 := make([]float64, len(x[i]))
+		acc0 := make([][3]float64, len(x[i]))
+		tree.Evaluate(0.01, Potential(phi0))
+		tree.Evaluate(0.01, Acceleration(acc0))
+
+		if len(phi[i]) != len(x[i]) || len(acc[i]) != len(x[i]) {
+			t.Fatalf("%d) Expected %d results, got len(phi) = %d and " +
+				"len(acc) = %d", i, len(x[i]), len(phi[i]), len(acc[i]))
+		}
+
+		for j := range phi0 {
+			if phi0[j] != phi[i][j] {
+				t.Errorf("%d) Expected phi[%d] = %g, got %g.",
+					i, j, phi0[j], phi[i][j])
+				break
+			}
+			if acc0[j] != acc[i][j] {
+				t.Errorf("%d) Expected acc[%d] = %g, got %g.",
+					i, j, acc0[j], acc[i][j])
+				break
+			}
+		}
+	}
+}
@@ -51,6 +51,31 @@ func benchmarkNewTree(b *testing.B, n int, filename string) {
 	}
 }
 
+func benchmarkPotentialOctree(b *testing.B, n int, filename string) {
+	x := readPointFile(filename)
+
+	tree := NewOctree(x)
+	phi := Potential(make([]float64, len(x)))
+
+	b.SetBytes(int64(24 * n))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		tree.Evaluate(0.0, phi)
+	}
+}
+
+func benchmarkNewOctree(b *testing.B, n int, filename string) {
+	x := readPointFile(filename)
+
+	b.SetBytes(int64(24 * n))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		NewOctree(x)
+	}
+}
+
 func benchmarkBruteForce(b *testing.B, n int, filename string) {
 	x := readPointFile(filename)
 	phi := make([]float64, len(x))
@@ -107,6 +132,50 @@ func BenchmarkNewTree_1e5(b *testing.B) {
 	benchmarkNewTree(b, int(1e5), "test_files/einasto_n=5_a=18.dat")
 }
 
+func BenchmarkPotentialOctree_1e2(b *testing.B) {
+	benchmarkPotentialOctree(b, int(1e2), "test_files/einasto_n=2_a=18.dat")
+}
+func BenchmarkPotentialOctree_3e2(b *testing.B) {
+	benchmarkPotentialOctree(b, int(3e2), "test_files/einasto_n=2.5_a=18.dat")
+}
+func BenchmarkPotentialOctree_1e3(b *testing.B) {
+	benchmarkPotentialOctree(b, int(1e3), "test_files/einasto_n=3_a=18.dat")
+}
+func BenchmarkPotentialOctree_3e3(b *testing.B) {
+	benchmarkPotentialOctree(b, int(3e3), "test_files/einasto_n=3.5_a=18.dat")
+}
+func BenchmarkPotentialOctree_1e4(b *testing.B) {
+	benchmarkPotentialOctree(b, int(1e4), "test_files/einasto_n=4_a=18.dat")
+}
+func BenchmarkPotentialOctree_3e4(b *testing.B) {
+	benchmarkPotentialOctree(b, int(3e4), "test_files/einasto_n=4.5_a=18.dat")
+}
+func BenchmarkPotentialOctree_1e5(b *testing.B) {
+	benchmarkPotentialOctree(b, int(1e5), "test_files/einasto_n=5_a=18.dat")
+}
+
+func BenchmarkNewOctree_1e2(b *testing.B) {
+	benchmarkNewOctree(b, int(1e2), "test_files/einasto_n=2_a=18.dat")
+}
+func BenchmarkNewOctree_3e2(b *testing.B) {
+	benchmarkNewOctree(b, int(3e2), "test_files/einasto_n=2.5_a=18.dat")
+}
+func BenchmarkNewOctree_1e3(b *testing.B) {
+	benchmarkNewOctree(b, int(1e3), "test_files/einasto_n=3_a=18.dat")
+}
+func BenchmarkNewOctree_3e3(b *testing.B) {
+	benchmarkNewOctree(b, int(3e3), "test_files/einasto_n=3.5_a=18.dat")
+}
+func BenchmarkNewOctree_1e4(b *testing.B) {
+	benchmarkNewOctree(b, int(1e4), "test_files/einasto_n=4_a=18.dat")
+}
+func BenchmarkNewOctree_3e4(b *testing.B) {
+	benchmarkNewOctree(b, int(3e4), "test_files/einasto_n=4.5_a=18.dat")
+}
+func BenchmarkNewOctree_1e5(b *testing.B) {
+	benchmarkNewOctree(b, int(1e5), "test_files/einasto_n=5_a=18.dat")
+}
+
 func BenchmarkBruteForce_1e2(b *testing.B) {
 	benchmarkBruteForce(b, int(1e2), "test_files/einasto_n=2_a=18.dat")
 }
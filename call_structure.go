@@ -1,17 +1,28 @@
 package gravitree
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
 type CallStructure struct {
 	Quantity Quantity
 	Sizes1, Sizes2 []int
-	NodeDepths []int // For tree1
+	NodeDepths []int // For tree1, with the root at depth 0.
 
 	// One call for each node in t2.
 	TwoSidedLeafCalls [][]Call
 	OneSidedLeafCalls [][]Call
 	ApproximateCalls [][]Call
+
+	children [][]int // The children of each node in t1.
 }
 var _ Quantity = &CallStructure{ } // type-checking
 
+// Call records the nodes passed to a Quantity method: I1 is the source node
+// in t1 and I2 is the target node in t2.
 type Call struct {
 	I1, I2 int
 }
@@ -27,24 +38,32 @@ func NewCallStructure(t1, t2 *Tree, q Quantity) *CallStructure {
 	}
 
 	depths := make([]int, len(t1.Nodes))
-	computeDepth(t1, 0, 1, depths)
+	if len(t1.Nodes) > 0 { computeDepth(t1, 0, 0, depths) }
+
+	children := make([][]int, len(t1.Nodes))
+	idx := t1.spatialIndex()
+	for i := range t1.Nodes {
+		for c, n := 0, idx.NumChildren(i); c < n; c++ {
+			children[i] = append(children[i], idx.Child(i, c))
+		}
+	}
 
 	return &CallStructure{
 		Quantity: q,
 		Sizes1: sizes1, Sizes2: sizes2,
+		NodeDepths: depths,
 		TwoSidedLeafCalls: make([][]Call, len(t2.Nodes)),
 		OneSidedLeafCalls: make([][]Call, len(t2.Nodes)),
 		ApproximateCalls: make([][]Call, len(t2.Nodes)),
+		children: children,
 	}
 }
 
 func computeDepth(t *Tree, node, depth int, depths []int) {
 	depths[node] = depth
-	if t.Nodes[node].Left != -1 {
-		computeDepth(t, t.Nodes[node].Left, depth+1, depths)
-	}
-	if t.Nodes[node].Right != -1 {
-		computeDepth(t, t.Nodes[node].Right, depth+1, depths)
+	idx := t.spatialIndex()
+	for c, n := 0, idx.NumChildren(node); c < n; c++ {
+		computeDepth(t, idx.Child(node, c), depth+1, depths)
 	}
 }
 
@@ -55,12 +74,237 @@ func (cs *CallStructure) TwoSidedLeaf(t *Tree, i int) {
 	cs.Quantity.TwoSidedLeaf(t, i)
 }
 
-func (cs *CallStructure) Approximate(t1, t2 *Tree, i2, i1 int) {
+func (cs *CallStructure) Approximate(t1, t2 *Tree, i1, i2 int) {
 	cs.ApproximateCalls[i2] = append(cs.ApproximateCalls[i2], Call{i1, i2})
-	cs.Quantity.Approximate(t1, t2, i2, i1)
+	cs.Quantity.Approximate(t1, t2, i1, i2)
 }
 
-func (cs *CallStructure) OneSidedLeaf(t1, t2 *Tree, i2, i1 int) {
+func (cs *CallStructure) OneSidedLeaf(t1, t2 *Tree, i1, i2 int) {
 	cs.OneSidedLeafCalls[i2] = append(cs.OneSidedLeafCalls[i2], Call{i1, i2})
-	cs.Quantity.OneSidedLeaf(t1, t2, i2, i1)
+	cs.Quantity.OneSidedLeaf(t1, t2, i1, i2)
+}
+
+// CallStats summarizes the calls recorded by a CallStructure.
+type CallStats struct {
+	TwoSidedLeafCalls, OneSidedLeafCalls, ApproximateCalls int
+
+	// The number of pairwise force evaluations performed by each type of
+	// call. An Approximate call counts as one evaluation per target point.
+	TwoSidedLeafEvals, OneSidedLeafEvals, ApproximateEvals int
+
+	// The ratio of Approximate calls to leaf-leaf (direct) calls.
+	ApproximateRatio float64
+
+	// Interactions[i] and Evals[i] are the number of calls made for target
+	// node i in t2 and the number of force evaluations that they performed.
+	// Nodes which aren't targets have zero interactions.
+	Interactions, Evals []int
+	// MeanInteractions and MaxInteractions are computed over target nodes.
+	MeanInteractions float64
+	MaxInteractions int
+
+	// OpenedDepths[d] is the number of times that a node in t1 at depth d
+	// was opened, summed over all target nodes.
+	OpenedDepths []int
+}
+
+// Stats computes summary statistics of the calls recorded by cs.
+func (cs *CallStructure) Stats() *CallStats {
+	n2 := len(cs.Sizes2)
+	s := &CallStats{ Interactions: make([]int, n2), Evals: make([]int, n2) }
+
+	maxDepth := 0
+	for _, d := range cs.NodeDepths {
+		if d > maxDepth { maxDepth = d }
+	}
+	// Calls made on each node in t1.
+	calls := make([]int, len(cs.Sizes1))
+
+	nTargets := 0
+	for i := 0; i < n2; i++ {
+		for _, c := range cs.TwoSidedLeafCalls[i] {
+			n := cs.Sizes1[c.I1]
+			s.TwoSidedLeafEvals += n*(n - 1)/2
+			s.Evals[i] += n*(n - 1)/2
+			calls[c.I1]++
+		}
+		for _, c := range cs.OneSidedLeafCalls[i] {
+			n := cs.Sizes1[c.I1]*cs.Sizes2[c.I2]
+			s.OneSidedLeafEvals += n
+			s.Evals[i] += n
+			calls[c.I1]++
+		}
+		for _, c := range cs.ApproximateCalls[i] {
+			n := cs.Sizes2[c.I2]
+			s.ApproximateEvals += n
+			s.Evals[i] += n
+			calls[c.I1]++
+		}
+
+		s.TwoSidedLeafCalls += len(cs.TwoSidedLeafCalls[i])
+		s.OneSidedLeafCalls += len(cs.OneSidedLeafCalls[i])
+		s.ApproximateCalls += len(cs.ApproximateCalls[i])
+
+		s.Interactions[i] = len(cs.TwoSidedLeafCalls[i]) +
+			len(cs.OneSidedLeafCalls[i]) + len(cs.ApproximateCalls[i])
+		if s.Interactions[i] > 0 { nTargets++ }
+		if s.Interactions[i] > s.MaxInteractions {
+			s.MaxInteractions = s.Interactions[i]
+		}
+	}
+
+	direct := s.TwoSidedLeafCalls + s.OneSidedLeafCalls
+	if direct > 0 {
+		s.ApproximateRatio = float64(s.ApproximateCalls) / float64(direct)
+	}
+	if nTargets > 0 {
+		s.MeanInteractions = float64(s.ApproximateCalls + direct) /
+			float64(nTargets)
+	}
+
+	s.OpenedDepths = make([]int, maxDepth + 1)
+	if len(cs.children) > 0 { cs.countOpened(0, calls, s.OpenedDepths) }
+
+	return s
+}
+
+// countOpened adds the number of times that node i and its descendants were
+// opened to opened and returns the number of times that i was visited. Every
+// opened node has all of its children visited, and every visited node is
+// either opened or called, so a node is opened once for each visit to any
+// one of its children.
+func (cs *CallStructure) countOpened(i int, calls, opened []int) int {
+	nOpened := 0
+	for c, child := range cs.children[i] {
+		visits := cs.countOpened(child, calls, opened)
+		if c == 0 { nOpened = visits }
+	}
+	opened[cs.NodeDepths[i]] += nOpened
+	return calls[i] + nOpened
+}
+
+// String returns a printable summary of the statistics.
+func (s *CallStats) String() string {
+	b := &strings.Builder{ }
+	fmt.Fprintf(b, "TwoSidedLeaf() calls: %d force evaluations: %d\n",
+		s.TwoSidedLeafCalls, s.TwoSidedLeafEvals)
+	fmt.Fprintf(b, "OneSidedLeaf() calls: %d force evaluations: %d\n",
+		s.OneSidedLeafCalls, s.OneSidedLeafEvals)
+	fmt.Fprintf(b, "Approximate() calls: %d force evaluations: %d\n",
+		s.ApproximateCalls, s.ApproximateEvals)
+	fmt.Fprintf(b, "Approximate/direct ratio: %.3g\n", s.ApproximateRatio)
+	fmt.Fprintf(b, "Interactions per target: mean %.3g max %d\n",
+		s.MeanInteractions, s.MaxInteractions)
+	fmt.Fprintf(b, "Opened nodes by depth:")
+	for d := range s.OpenedDepths {
+		fmt.Fprintf(b, " %d", s.OpenedDepths[d])
+	}
+	fmt.Fprintf(b, "\n")
+	return b.String()
+}
+
+// callStructureJSON is the format that CallStructure.WriteJSON writes.
+type callStructureJSON struct {
+	Sizes1 []int
+	Sizes2 []int
+	NodeDepths []int
+	Targets []targetCallsJSON
+	Stats *CallStats
+}
+
+type targetCallsJSON struct {
+	Node int
+	TwoSidedLeaf []int
+	OneSidedLeaf []int
+	Approximate []int
+}
+
+// WriteJSON writes the recorded calls and their statistics to w as JSON. Each
+// target node in t2 lists the source nodes in t1 of each of its calls.
+func (cs *CallStructure) WriteJSON(w io.Writer) error {
+	out := &callStructureJSON{
+		Sizes1: cs.Sizes1, Sizes2: cs.Sizes2, NodeDepths: cs.NodeDepths,
+		Targets: []targetCallsJSON{ }, Stats: cs.Stats(),
+	}
+
+	for i := range cs.Sizes2 {
+		if len(cs.TwoSidedLeafCalls[i]) + len(cs.OneSidedLeafCalls[i]) +
+			len(cs.ApproximateCalls[i]) == 0 { continue }
+
+		out.Targets = append(out.Targets, targetCallsJSON{
+			Node: i,
+			TwoSidedLeaf: callSources(cs.TwoSidedLeafCalls[i]),
+			OneSidedLeaf: callSources(cs.OneSidedLeafCalls[i]),
+			Approximate: callSources(cs.ApproximateCalls[i]),
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func callSources(calls []Call) []int {
+	out := make([]int, len(calls))
+	for i := range calls { out[i] = calls[i].I1 }
+	return out
+}
+
+// WriteDOT writes the part of t1 walked for the target node, target, as a
+// Graphviz DOT graph. t1 must be the tree that cs was recorded with. Opened
+// nodes are drawn in gray, approximated nodes in green, and nodes evaluated
+// directly in red. Each node is labeled with its index, size, and depth.
+func (cs *CallStructure) WriteDOT(w io.Writer, t1 *Tree, target int) error {
+	if len(t1.Nodes) != len(cs.Sizes1) {
+		return fmt.Errorf("CallStructure was recorded with a tree that " +
+			"has %d nodes, but t1 has %d nodes", len(cs.Sizes1),
+			len(t1.Nodes))
+	} else if target < 0 || target >= len(cs.Sizes2) {
+		return fmt.Errorf("target node %d is out of range [0, %d)",
+			target, len(cs.Sizes2))
+	}
+
+	color := map[int]string{ }
+	for _, c := range cs.ApproximateCalls[target] {
+		color[c.I1] = "green"
+	}
+	for _, c := range cs.OneSidedLeafCalls[target] {
+		color[c.I1] = "red"
+	}
+	for _, c := range cs.TwoSidedLeafCalls[target] {
+		color[c.I1] = "red"
+	}
+
+	// Mark the ancestors of every called node as opened.
+	parent := make([]int, len(t1.Nodes))
+	idx := t1.spatialIndex()
+	for i := range t1.Nodes {
+		for c, n := 0, idx.NumChildren(i); c < n; c++ {
+			parent[idx.Child(i, c)] = i
+		}
+	}
+	called := make([]int, 0, len(color))
+	for i := range color { called = append(called, i) }
+	for _, i := range called {
+		for j := i; j != 0; {
+			j = parent[j]
+			if _, ok := color[j]; ok { break }
+			color[j] = "gray"
+		}
+	}
+
+	b := &strings.Builder{ }
+	fmt.Fprintf(b, "digraph target_%d {\n", target)
+	fmt.Fprintf(b, "\tnode [style=filled];\n")
+	for i := range t1.Nodes {
+		c, ok := color[i]
+		if !ok { continue }
+		fmt.Fprintf(b, "\tn%d [label=\"%d\\nn=%d\\nd=%d\", fillcolor=%s];\n",
+			i, i, cs.Sizes1[i], cs.NodeDepths[i], c)
+		if i != 0 { fmt.Fprintf(b, "\tn%d -> n%d;\n", parent[i], i) }
+	}
+	fmt.Fprintf(b, "}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
 }
@@ -0,0 +1,108 @@
+package gravitree
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// countOpened repeats the walk done by walkNodeEvaluate and counts the number
+// of opened nodes at each depth.
+func countOpened(idx SpatialIndex, i, j int, depths, opened []int) {
+	t := idx.Base()
+	if i == j || t.useApproximation(t, i, j) || t.Nodes[i].Left == -1 {
+		return
+	}
+	opened[depths[i]]++
+	for c, n := 0, idx.NumChildren(i); c < n; c++ {
+		countOpened(idx, idx.Child(i, c), j, depths, opened)
+	}
+}
+
+func TestCallStats(t *testing.T) {
+	rand.Seed(4)
+	x := randomPoints(3000)
+	for _, idx := range []SpatialIndex{ NewTree(x), NewOctree(x) } {
+		tree := idx.Base()
+
+		phi := make([]float64, len(x))
+		cs := NewCallStructure(tree, tree, Potential(phi))
+		tree.Evaluate(0.01, cs)
+		s := cs.Stats()
+
+		opened := make([]int, len(s.OpenedDepths))
+		nLeaf := 0
+		for j := range tree.Nodes {
+			if tree.Nodes[j].Left == -1 {
+				nLeaf++
+				countOpened(idx, 0, j, cs.NodeDepths, opened)
+			}
+		}
+
+		for d := range opened {
+			if opened[d] != s.OpenedDepths[d] {
+				t.Errorf("%T: Expected OpenedDepths = %d, got %d.",
+					idx, opened, s.OpenedDepths)
+				break
+			}
+		}
+
+		if s.TwoSidedLeafCalls != nLeaf {
+			t.Errorf("%T: Expected %d TwoSidedLeaf calls, got %d.",
+				idx, nLeaf, s.TwoSidedLeafCalls)
+		}
+
+		nEvals, nInteractions := 0, 0
+		for i := range s.Evals {
+			nEvals += s.Evals[i]
+			nInteractions += s.Interactions[i]
+		}
+		if nEvals != s.TwoSidedLeafEvals + s.OneSidedLeafEvals +
+			s.ApproximateEvals {
+			t.Errorf("%T: Per-target evaluations don't sum to the total.",
+				idx)
+		}
+		if nInteractions != s.TwoSidedLeafCalls + s.OneSidedLeafCalls +
+			s.ApproximateCalls {
+			t.Errorf("%T: Per-target interactions don't sum to the total.",
+				idx)
+		}
+	}
+}
+
+func TestCallStructureExport(t *testing.T) {
+	rand.Seed(5)
+	x := randomPoints(500)
+	tree := NewTree(x)
+
+	phi := make([]float64, len(x))
+	cs := NewCallStructure(tree, tree, Potential(phi))
+	tree.Evaluate(0.01, cs)
+
+	buf := &bytes.Buffer{ }
+	if err := cs.WriteJSON(buf); err != nil {
+		t.Fatalf("WriteJSON failed: %s", err.Error())
+	}
+	out := &callStructureJSON{ }
+	if err := json.Unmarshal(buf.Bytes(), out); err != nil {
+		t.Fatalf("Could not decode JSON output: %s", err.Error())
+	}
+	if len(out.Sizes1) != len(tree.Nodes) || len(out.Targets) == 0 {
+		t.Errorf("JSON output is missing nodes or targets.")
+	}
+
+	target := out.Targets[len(out.Targets)/2].Node
+	buf.Reset()
+	if err := cs.WriteDOT(buf, tree, target); err != nil {
+		t.Fatalf("WriteDOT failed: %s", err.Error())
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph") || !strings.Contains(dot, "n0 [") {
+		t.Errorf("WriteDOT output doesn't describe the walk:\n%s", dot)
+	}
+	if err := cs.WriteDOT(buf, tree, len(tree.Nodes)); err == nil {
+		t.Errorf("Expected an error for an out-of-range target.")
+	}
+}
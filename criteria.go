@@ -0,0 +1,162 @@
+package gravitree
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// RelativeCriteria is the relative opening criteria used by Gadget (Springel
+// 2005, Eq. 18). A node with mass M and width l at a distance r from a target
+// point is approximated if
+//
+//   M l^2 / r^4 <= Alpha |a_old|
+//
+// where |a_old| is the magnitude of the target's acceleration from a previous
+// step. This gives a roughly constant relative force error for every point,
+// which the geometric criteria can't do. Opening decisions are made for entire
+// target leaves, so the smallest |a_old| in the leaf and the smallest distance
+// to any point in the leaf are used. Nodes are also always opened when the
+// leaf overlaps them. Theta is ignored.
+//
+// Since there are no old accelerations before the first step, the first step
+// should be computed with one of the geometric criteria. The smallest |a_old|
+// of each leaf is cached for the most recent target tree, so a new
+// RelativeCriteria should be made if the target tree is rebuilt in place.
+type RelativeCriteria struct {
+	Alpha float64
+	acc2 []float64 // |a_old|^2 in the input order of the target points.
+
+	leaves atomic.Pointer[leafAcc2]
+	mtx sync.Mutex // Held while leaves is computed.
+}
+
+// leafAcc2 holds the smallest |a_old|^2 of each leaf in a target tree.
+type leafAcc2 struct {
+	t *Tree
+	minAcc2 []float64
+}
+
+// NewRelativeCriteria creates a RelativeCriteria with the accuracy
+// parameter, alpha, and the old accelerations of the target points, acc.
+// acc should be in the same units as Acceleration results (i.e. unit point
+// masses and G = 1) and in the same order as the points used to make the
+// target tree.
+func NewRelativeCriteria(alpha float64, acc [][3]float64) *RelativeCriteria {
+	acc2 := make([]float64, len(acc))
+	for i := range acc {
+		acc2[i] = acc[i][0]*acc[i][0] + acc[i][1]*acc[i][1] +
+			acc[i][2]*acc[i][2]
+	}
+	return &RelativeCriteria{ Alpha: alpha, acc2: acc2 }
+}
+
+// ROpen2 returns M l^2 for node i, where l is the largest width of the node.
+func (c *RelativeCriteria) ROpen2(
+	t *Tree, i int, span [2][3]float64,
+) float64 {
+	node := &t.Nodes[i]
+	width := 0.0
+	for k := 0; k < 3; k++ {
+		width = math.Max(width, span[1][k] - span[0][k])
+	}
+	return float64(node.End - node.Start) * width*width
+}
+
+func (c *RelativeCriteria) UseApproximation(t1, t2 *Tree, i1, i2 int) bool {
+	node2, node1 := &t2.Nodes[i2], &t1.Nodes[i1]
+
+	r := math.Sqrt(calcR2(&node1.Center, &node2.Center)) - node2.RMax
+	if r <= node1.RMax { return false }
+
+	minAcc2 := c.leafMinAcc2(t2)[i2]
+
+	// M l^2 <= Alpha |a_old| r^4, squared to avoid a square root.
+	r4 := r*r*r*r
+	return node1.ROpen2*node1.ROpen2 <= c.Alpha*c.Alpha * minAcc2 * r4*r4
+}
+
+// leafMinAcc2 returns the smallest |a_old|^2 of each leaf of t2, indexed by
+// node. It's computed the first time that t2 is seen and reused afterwards.
+func (c *RelativeCriteria) leafMinAcc2(t2 *Tree) []float64 {
+	if l := c.leaves.Load(); l != nil && l.t == t2 { return l.minAcc2 }
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	// Another worker may have computed it while this one waited.
+	if l := c.leaves.Load(); l != nil && l.t == t2 { return l.minAcc2 }
+
+	l := &leafAcc2{ t: t2, minAcc2: make([]float64, len(t2.Nodes)) }
+	for i := range t2.Nodes {
+		node := &t2.Nodes[i]
+		if node.Left != -1 { continue }
+		l.minAcc2[i] = math.Inf(+1)
+		for j := node.Start; j < node.End; j++ {
+			l.minAcc2[i] = math.Min(l.minAcc2[i], c.acc2[t2.Index[j]])
+		}
+	}
+	c.leaves.Store(l)
+	return l.minAcc2
+}
+
+// BoxCriteria opens nodes based on the exact minimum distance between the
+// source node's center of mass and the bounding box of the target leaf. Each
+// node has an opening radius R_open = R_max/theta, and the node is
+// approximated if every point in the target's bounding box is farther than
+// R_open from its center. Unlike the sphere-based built-in criteria, this
+// isn't overly conservative for the elongated nodes that k-d trees can
+// produce, and it guarantees that every target point is at least R_open away.
+type BoxCriteria struct{ }
+
+func (BoxCriteria) ROpen2(t *Tree, i int, span [2][3]float64) float64 {
+	return t.Nodes[i].RMax2 / (t.Theta*t.Theta)
+}
+
+func (BoxCriteria) UseApproximation(t1, t2 *Tree, i1, i2 int) bool {
+	node2, node1 := &t2.Nodes[i2], &t1.Nodes[i1]
+	return boxDist2(&node1.Center, &node2.Span) > node1.ROpen2
+}
+
+// SalmonWarrenAbsolute is an opening criteria which guarantees that the
+// acceleration error of each Approximate call is at most MaxError at every
+// target point. MaxError is in the same units as Acceleration results (i.e.
+// unit point masses and G = 1). The Salmon & Warren (1994) bound on the
+// monopole error of a node at distance d from a target point is
+//
+//   dAcc <= 3 B_2 / (d^2 (d - b_max)^2)
+//
+// where B_2 is the sum of |x - x_cm|^2 over the node's points and b_max is
+// its RMax, so each node's opening radius is the d where this equals MaxError:
+//
+//   R_open = b_max/2 + sqrt(b_max^2/4 + sqrt(3 B_2 / MaxError))
+//
+// Nodes are approximated when every point in the target's bounding box is
+// farther than R_open from the node's center. The bound is derived for
+// unsoftened forces, and softening generally makes the true errors smaller.
+// Theta is ignored.
+//
+// The guarantee only applies to Monopole trees. Higher orders usually have
+// smaller errors at the same distance, but the bound isn't derived for them
+// and isn't enforced. SalmonWarrenAbsolute can't be used with Adaptive.
+type SalmonWarrenAbsolute struct {
+	MaxError float64
+}
+
+func (c SalmonWarrenAbsolute) ROpen2(
+	t *Tree, i int, span [2][3]float64,
+) float64 {
+	node := &t.Nodes[i]
+
+	b2 := 0.0
+	for j := node.Start; j < node.End; j++ {
+		b2 += calcR2(&node.Center, &t.Points[j])
+	}
+
+	rOpen := node.RMax/2 + math.Sqrt(node.RMax2/4 + math.Sqrt(3*b2/c.MaxError))
+	return rOpen*rOpen
+}
+
+func (c SalmonWarrenAbsolute) UseApproximation(t1, t2 *Tree, i1, i2 int) bool {
+	node2, node1 := &t2.Nodes[i2], &t1.Nodes[i1]
+	return boxDist2(&node1.Center, &node2.Span) > node1.ROpen2
+}
@@ -0,0 +1,138 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func normalPoints(n int) [][3]float64 {
+	x := make([][3]float64, n)
+	for i := range x {
+		for k := 0; k < 3; k++ {
+			x[i][k] = rand.NormFloat64()
+		}
+	}
+	return x
+}
+
+func TestRelativeCriteria(t *testing.T) {
+	rand.Seed(9)
+	x := normalPoints(3000)
+	eps := 0.01
+
+	tree := NewTree(x)
+	accOld := make([][3]float64, len(x))
+	tree.Evaluate(eps, Acceleration(accOld))
+
+	prevP99 := 1.0
+	for _, alpha := range []float64{ 1e-2, 1e-3, 1e-4 } {
+		tree := NewTree(x, TreeOptions{
+			Criteria: NewRelativeCriteria(alpha, accOld) })
+		acc := make([][3]float64, len(x))
+		tree.Evaluate(eps, Acceleration(acc))
+
+		err := tree.AuditAcceleration(eps, acc, 300, 0)
+		if err.P99 > 2*alpha || err.P99 > prevP99 {
+			t.Errorf("alpha = %g gave errors %s.", alpha, err)
+		}
+		prevP99 = err.P99
+	}
+
+	// The smallest old acceleration of each leaf is computed once.
+	c := NewRelativeCriteria(1e-3, accOld)
+	minAcc2 := c.leafMinAcc2(tree)
+	for i := range tree.Nodes {
+		node := &tree.Nodes[i]
+		if node.Left != -1 { continue }
+		exp := math.Inf(+1)
+		for j := node.Start; j < node.End; j++ {
+			exp = math.Min(exp, c.acc2[tree.Index[j]])
+		}
+		if minAcc2[i] != exp {
+			t.Errorf("Leaf %d has min |a_old|^2 = %g, expected %g.",
+				i, minAcc2[i], exp)
+		}
+	}
+	if &c.leafMinAcc2(tree)[0] != &minAcc2[0] {
+		t.Errorf("Leaf accelerations were recomputed for the same tree.")
+	}
+}
+
+func TestBoxCriteria(t *testing.T) {
+	rand.Seed(10)
+	x := normalPoints(3000)
+	tree := NewTree(x, TreeOptions{ Criteria: BoxCriteria{ }, Theta: 0.5 })
+
+	acc := make([][3]float64, len(x))
+	cs := NewCallStructure(tree, tree, Acceleration(acc))
+	tree.Evaluate(0.01, cs)
+
+	// Every approximated node must be at least R_open away from all of its
+	// targets.
+	for i2 := range cs.ApproximateCalls {
+		for _, c := range cs.ApproximateCalls[i2] {
+			node1, node2 := &tree.Nodes[c.I1], &tree.Nodes[c.I2]
+			for j := node2.Start; j < node2.End; j++ {
+				if calcR2(&node1.Center, &tree.Points[j]) <= node1.ROpen2 {
+					t.Fatalf("Point %d is within R_open of node %d.",
+						j, c.I1)
+				}
+			}
+		}
+	}
+
+	err := tree.AuditAcceleration(0.01, acc, 300, 0)
+	if err.P99 > 3e-2 {
+		t.Errorf("BoxCriteria gave errors %s.", err)
+	}
+}
+
+func TestSalmonWarrenAbsolute(t *testing.T) {
+	rand.Seed(11)
+	x := normalPoints(3000)
+
+	accBrute := make([][3]float64, len(x))
+	BruteForceAcceleration(0, x, accBrute)
+
+	for _, maxErr := range []float64{ 10, 1, 0.1 } {
+		tree := NewTree(x, TreeOptions{
+			Criteria: SalmonWarrenAbsolute{ MaxError: maxErr } })
+
+		acc := make([][3]float64, len(x))
+		cs := NewCallStructure(tree, tree, Acceleration(acc))
+		tree.Evaluate(0, cs)
+
+		// The error of each point is bounded by MaxError times the number
+		// of approximated nodes that it interacted with.
+		nApprox := make([]int, len(x))
+		for i2 := range cs.ApproximateCalls {
+			node := &tree.Nodes[i2]
+			for j := node.Start; j < node.End; j++ {
+				nApprox[tree.Index[j]] += len(cs.ApproximateCalls[i2])
+			}
+		}
+
+		nTotal := 0
+		for i := range x {
+			nTotal += nApprox[i]
+
+			dAcc := 0.0
+			for k := 0; k < 3; k++ {
+				dx := acc[i][k] - accBrute[i][k]
+				dAcc += dx*dx
+			}
+			dAcc = math.Sqrt(dAcc)
+
+			if dAcc > maxErr*float64(nApprox[i]) + 1e-9 {
+				t.Errorf("MaxError = %g: acc[%d] has error %g from %d " +
+					"approximations.", maxErr, i, dAcc, nApprox[i])
+				break
+			}
+		}
+
+		if nTotal == 0 {
+			t.Errorf("MaxError = %g: no nodes were approximated.", maxErr)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package gravitree
+
+import (
+	"fmt"
+	"math"
+)
+
+// ErrorEstimate wraps a Potential or an Acceleration and accumulates an upper
+// bound on the error of each point's result alongside it. The bound is the
+// sum over every Approximate call of the Salmon & Warren (1994) bound on the
+// truncated multipole terms:
+//
+//   dPhi <= B_(p+1) / (d^(p+1) (d - b_max))
+//   dAcc <= ((p+2) B_(p+1)/d^(p+1) - (p+1) B_(p+2)/d^(p+2)) / (d - b_max)^2
+//
+// where B_n is the sum of |x - x_cm|^n over the points in the approximated
+// node, b_max is its RMax, d is the distance between the target point and the
+// node's center of mass, and p is the order of the expansion (p = 1 for the
+// monopole, since the dipole moment about the center of mass vanishes, and
+// p = 2 for the quadrupole). Adaptive trees use the order of each call. Leaf
+// interactions are exact and add no error. The bounds are derived for
+// unsoftened forces, and softening generally makes the true errors smaller.
+// If d <= b_max, the bound is infinite.
+//
+// Points with large Err values can be flagged or re-evaluated directly.
+type ErrorEstimate struct {
+	Quantity Quantity
+	Err []float64 // Error bound for each point, in input order.
+
+	acceleration bool
+	b [][]float64 // b[n][i] is B_n for node i of t1.
+}
+var _ Quantity = &ErrorEstimate{ } // type-checking
+
+// NewPotentialError creates an ErrorEstimate which evaluates phi and writes
+// error bounds on it to err. t1 must be the tree that will be used to
+// evaluate phi.
+func NewPotentialError(t1 *Tree, phi Potential, err []float64) *ErrorEstimate {
+	return newErrorEstimate(t1, phi, err, false)
+}
+
+// NewAccelerationError creates an ErrorEstimate which evaluates acc and
+// writes error bounds on the magnitude of each acceleration vector to err. t1
+// must be the tree that will be used to evaluate acc.
+func NewAccelerationError(
+	t1 *Tree, acc Acceleration, err []float64,
+) *ErrorEstimate {
+	return newErrorEstimate(t1, acc, err, true)
+}
+
+func newErrorEstimate(
+	t1 *Tree, q Quantity, err []float64, acceleration bool,
+) *ErrorEstimate {
+	if len(err) != q.Len() {
+		panic(fmt.Sprintf("len(q) = %d, but len(err) = %d",
+			q.Len(), len(err)))
+	}
+
+	order := t1.Order
+	if order == Adaptive { order = maxAdaptiveOrder }
+	return &ErrorEstimate{
+		Quantity: q, Err: err, acceleration: acceleration,
+		b: nodeMoments(t1, int(order) + 3),
+	}
+}
+
+// nodeMoments returns b[n][i], the sum of |x - x_cm|^n over the points in
+// node i for 0 <= n <= nMax.
+func nodeMoments(t *Tree, nMax int) [][]float64 {
+	b := make([][]float64, nMax + 1)
+	for n := range b { b[n] = make([]float64, len(t.Nodes)) }
+
+	for i := range t.Nodes {
+		node := &t.Nodes[i]
+		for j := node.Start; j < node.End; j++ {
+			r := math.Sqrt(calcR2(&node.Center, &t.Points[j]))
+			rn := 1.0
+			for n := range b {
+				b[n][i] += rn
+				rn *= r
+			}
+		}
+	}
+
+	return b
+}
+
+func (e *ErrorEstimate) Len() int { return e.Quantity.Len() }
+
+func (e *ErrorEstimate) TwoSidedLeaf(t *Tree, i int) {
+	e.Quantity.TwoSidedLeaf(t, i)
+}
+
+func (e *ErrorEstimate) OneSidedLeaf(t1, t2 *Tree, i1, i2 int) {
+	e.Quantity.OneSidedLeaf(t1, t2, i1, i2)
+}
+
+func (e *ErrorEstimate) Approximate(t1, t2 *Tree, i1, i2 int) {
+	e.Quantity.Approximate(t1, t2, i1, i2)
+
+	node_i2, node_i1 := &t2.Nodes[i2], &t1.Nodes[i1]
+	x_i1, bMax := &node_i1.Center, node_i1.RMax
+	p := int(t1.approximationOrder(t2, i1, i2)) + 1
+	b1, b2 := e.b[p + 1][i1], e.b[p + 2][i1]
+
+	for i2 := node_i2.Start; i2 < node_i2.End; i2++ {
+		idx_i2 := t2.Index[i2]
+		d := math.Sqrt(calcR2(x_i1, &t2.Points[i2]))
+		if d <= bMax {
+			e.Err[idx_i2] = math.Inf(+1)
+			continue
+		}
+
+		dp1 := math.Pow(d, float64(p + 1))
+		if e.acceleration {
+			p := float64(p)
+			e.Err[idx_i2] += ((p + 2)*b1/dp1 - (p + 1)*b2/(dp1*d)) /
+				((d - bMax)*(d - bMax))
+		} else {
+			e.Err[idx_i2] += b1 / (dp1*(d - bMax))
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestErrorEstimate(t *testing.T) {
+	rand.Seed(6)
+	x := randomPoints(2000)
+
+	tests := []struct {
+		criteria OpeningCriteria
+		theta float64
+	}{
+		{PKDGRAV3, 0.7},
+		{PKDGRAV3, 1.0},
+		{SalmonWarren, 0.5},
+	}
+
+	phiBrute := make([]float64, len(x))
+	BruteForcePotential(0, x, phiBrute)
+	accBrute := make([][3]float64, len(x))
+	BruteForceAcceleration(0, x, accBrute)
+
+	for i := range tests {
+		test := tests[i]
+		tree := NewTree(x, TreeOptions{
+			Criteria: test.criteria, Theta: test.theta })
+
+		phi, phiErr := make([]float64, len(x)), make([]float64, len(x))
+		tree.Evaluate(0, NewPotentialError(tree, phi, phiErr))
+		acc, accErr := make([][3]float64, len(x)), make([]float64, len(x))
+		tree.Evaluate(0, NewAccelerationError(tree, acc, accErr))
+
+		nNonZero := 0
+		for j := range x {
+			if phiErr[j] > 0 { nNonZero++ }
+
+			dPhi := math.Abs(phi[j] - phiBrute[j])
+			if dPhi > phiErr[j]*(1 + 1e-6) + 1e-9 {
+				t.Errorf("%d) phi[%d] has error %g, but the bound is %g.",
+					i, j, dPhi, phiErr[j])
+				break
+			}
+
+			dAcc := 0.0
+			for k := 0; k < 3; k++ {
+				dx := acc[j][k] - accBrute[j][k]
+				dAcc += dx*dx
+			}
+			dAcc = math.Sqrt(dAcc)
+			if dAcc > accErr[j]*(1 + 1e-6) + 1e-9 {
+				t.Errorf("%d) acc[%d] has error %g, but the bound is %g.",
+					i, j, dAcc, accErr[j])
+				break
+			}
+		}
+
+		if nNonZero == 0 {
+			t.Errorf("%d) No points have non-zero error bounds.", i)
+		}
+	}
+}
@@ -11,64 +11,95 @@ type Quantity interface {
 	OneSidedLeaf(t, t2 *Tree, i1, i2 int) // Evaluate quantity of j at i
 }
 
+// useApproximation returns true if node i1 of t1 can be approximated when
+// evaluating quantities at the points in node i2 of t2.
 func (t1 *Tree) useApproximation(t2 *Tree, i1, i2 int) bool {
-	node2, node1 := &t2.Nodes[i2], &t1.Nodes[i1]
-
-	x_i1, x_i2 := &node1.Center, &node2.Center
-	dx := x_i2[0] - x_i1[0]
-	dy := x_i2[1] - x_i1[1]
-	dz := x_i2[2] - x_i1[2]
-	dx2 := dx*dx + dy*dy + dz*dz
-	
-	return dx2 > node2.RMax2+node1.ROpen2
+	// This is called in the innermost part of the walk, so the built-in
+	// criteria skip the dynamic call.
+	switch t1.Criteria.(type) {
+	case nil, PKDGRAV3Criteria, SalmonWarrenCriteria, BarnesHutCriteria:
+		return useSphereApproximation(t1, t2, i1, i2)
+	}
+	return t1.Criteria.UseApproximation(t1, t2, i1, i2)
 }
 
 func (t *Tree) Evaluate(eps float64, q Quantity) {
+	evaluate(t.spatialIndex(), nWorkers, eps, q)
+}
+
+// evaluate is the same as Evaluate, except that it walks any SpatialIndex
+// and uses the given number of workers. If workers is 1, the walk runs on the
+// caller's goroutine.
+func evaluate(idx SpatialIndex, workers int, eps float64, q Quantity) {
+	t := idx.Base()
 	if q.Len() != len(t.Points) {
 		panic(fmt.Sprintf("Tree has %d points, but len(q) = %d",
 			len(t.Nodes), q.Len()))
 	}
 
 	t.eps2 = eps * eps
-	WorkerQueue(nWorkers, len(t.Nodes), func(worker, i int) {		
+	if workers == 1 {
+		for i := range t.Nodes {
+			if t.Nodes[i].Left == -1 {
+				walkNodeEvaluate(idx, t, 0, i, q)
+			}
+		}
+		return
+	}
+
+	WorkerQueue(workers, len(t.Nodes), func(worker, i int) {		
 		if t.Nodes[i].Left == -1 {
-			t.walkNodeEvaluate(0, i, q)
+			walkNodeEvaluate(idx, t, 0, i, q)
 		}
 	})
 }
 
 
-func (t *Tree) walkNodeEvaluate(i, j int, q Quantity) {
-	target := &t.Nodes[i]
-	
+func walkNodeEvaluate(idx SpatialIndex, t *Tree, i, j int, q Quantity) {
 	if i == j {
 		q.TwoSidedLeaf(t, i)
 	} else if t.useApproximation(t, i, j) {
 		q.Approximate(t, t, i, j) // passing in the same tree
-	} else if target.Left == -1 {
+	} else if t.Nodes[i].Left == -1 {
 		q.OneSidedLeaf(t, t, i, j) // passing in the same tree
+	} else if _, ok := idx.(*Tree); ok {
+		// k-d trees skip the dynamic calls, as in useApproximation.
+		walkNodeEvaluate(idx, t, t.Nodes[i].Left, j, q)
+		walkNodeEvaluate(idx, t, t.Nodes[i].Right, j, q)
 	} else {
-		t.walkNodeEvaluate(target.Left, j, q)
-		t.walkNodeEvaluate(target.Right, j, q)
+		for c, n := 0, idx.NumChildren(i); c < n; c++ {
+			walkNodeEvaluate(idx, t, idx.Child(i, c), j, q)
+		}
 	}
 }
 
 // Same function as walkNodeEvaluate except it calculates quantities
 // for a secondary tree.
-func (t1 *Tree) walkNodeEvaluateAt(t2 *Tree, i1, i2 int, q Quantity) {
-	target := &t1.Nodes[i1]
-
+func walkNodeEvaluateAt(
+	idx1 SpatialIndex, t1, t2 *Tree, i1, i2 int, q Quantity,
+) {
 	if t1.useApproximation(t2, i1, i2) {
 		q.Approximate(t1, t2, i1, i2) // passing in the secondary tree
-	} else if target.Left == -1 {
+	} else if t1.Nodes[i1].Left == -1 {
 		q.OneSidedLeaf(t1, t2, i1, i2)
+	} else if _, ok := idx1.(*Tree); ok {
+		walkNodeEvaluateAt(idx1, t1, t2, t1.Nodes[i1].Left, i2, q)
+		walkNodeEvaluateAt(idx1, t1, t2, t1.Nodes[i1].Right, i2, q)
 	} else {
-		t1.walkNodeEvaluateAt(t2, target.Left, i2, q)
-		t1.walkNodeEvaluateAt(t2, target.Right, i2, q)
+		for c, n := 0, idx1.NumChildren(i1); c < n; c++ {
+			walkNodeEvaluateAt(idx1, t1, t2, idx1.Child(i1, c), i2, q)
+		}
 	}
 }
 
 func (t1 *Tree) EvaluateAt(t2 *Tree, eps float64, q Quantity) {
+	evaluateAt(t1.spatialIndex(), t2, eps, q)
+}
+
+// evaluateAt is the same as EvaluateAt, except that the source points can be
+// stored in any SpatialIndex.
+func evaluateAt(idx1 SpatialIndex, t2 *Tree, eps float64, q Quantity) {
+	t1 := idx1.Base()
 	if q.Len() != len(t2.Points) {
 		panic(fmt.Sprintf("Tree has %d points, but len(q) = %d",
 			len(t2.Nodes), q.Len()))
@@ -78,7 +109,7 @@ func (t1 *Tree) EvaluateAt(t2 *Tree, eps float64, q Quantity) {
 
 	WorkerQueue(nWorkers, len(t2.Nodes), func(worker, i2 int) {
 		if t2.Nodes[i2].Left == -1 {
-			t1.walkNodeEvaluateAt(t2, 0, i2, q)
+			walkNodeEvaluateAt(idx1, t1, t2, 0, i2, q)
 		}
 	})
 }
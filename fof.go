@@ -0,0 +1,161 @@
+package gravitree
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// FoFGroups contains the results of a friends-of-friends group search.
+type FoFGroups struct {
+	// ID[i] is the group of the i-th input point, or -1 if the point is in a
+	// group with fewer than the minimum number of members.
+	ID []int
+	// Sizes[g] is the number of members of group g. Groups are sorted from
+	// largest to smallest, with ties ordered by their first member.
+	Sizes []int
+}
+
+// FriendsOfFriends links every pair of points in t separated by less than the
+// linking length, b, and returns the connected groups with at least
+// minMembers points. Each leaf searches the tree for nearby leaves in
+// parallel, and groups are joined with a lock-free union-find.
+func (t *Tree) FriendsOfFriends(b float64, minMembers int) *FoFGroups {
+	if b < 0 {
+		panic(fmt.Sprintf("Linking length must be non-negative, got %g.", b))
+	}
+
+	// parent is indexed by position in t.Points.
+	parent := make([]int64, len(t.Points))
+	for i := range parent { parent[i] = int64(i) }
+
+	idx, b2 := t.spatialIndex(), b*b
+	WorkerQueue(nWorkers, len(t.Nodes), func(worker, i int) {
+		if t.Nodes[i].Left == -1 {
+			linkLeaf(idx, t, 0, i, b2, parent)
+		}
+	})
+
+	// Label groups by their roots.
+	root := make([]int, len(t.Points))
+	WorkerQueue(nWorkers, len(t.Nodes), func(worker, i int) {
+		if t.Nodes[i].Left != -1 { return }
+		for j := t.Nodes[i].Start; j < t.Nodes[i].End; j++ {
+			root[j] = int(unionFind(parent, int64(j)))
+		}
+	})
+
+	return newFoFGroups(root, t.Index, minMembers)
+}
+
+// newFoFGroups labels the groups of a FoF search, where root[j] is the root
+// of the j-th point in a tree and index[j] is its original index. Roots must
+// be in [0, len(root)).
+func newFoFGroups(root, index []int, minMembers int) *FoFGroups {
+	// Roots are positions in the tree, so groups can be tallied in arrays.
+	size, first := make([]int, len(root)), make([]int, len(root))
+	for j := range root {
+		r, idx := root[j], index[j]
+		if size[r] == 0 || idx < first[r] { first[r] = idx }
+		size[r]++
+	}
+
+	roots := []int{ }
+	for r := range size {
+		if size[r] > 0 && size[r] >= minMembers { roots = append(roots, r) }
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		ri, rj := roots[i], roots[j]
+		if size[ri] != size[rj] { return size[ri] > size[rj] }
+		return first[ri] < first[rj]
+	})
+
+	groups := &FoFGroups{ ID: make([]int, len(root)),
+		Sizes: make([]int, len(roots)) }
+	// Reuse first to hold the group ID of each root.
+	for r := range first { first[r] = -1 }
+	for g, r := range roots {
+		first[r], groups.Sizes[g] = g, size[r]
+	}
+	for j := range root {
+		groups.ID[index[j]] = first[root[j]]
+	}
+
+	return groups
+}
+
+// linkLeaf links the points in leaf i2 to the points in the nodes below
+// node i1 that are within sqrt(b2) of them. Each pair of leaves is only
+// linked once, by the leaf which comes first in t.Points.
+func linkLeaf(
+	idx SpatialIndex, t *Tree, i1, i2 int, b2 float64, parent []int64,
+) {
+	node1, node2 := &t.Nodes[i1], &t.Nodes[i2]
+	if node1.End <= node2.Start ||
+		boxBoxDist2(&node1.Span, &node2.Span) >= b2 { return }
+
+	if i1 != i2 && node1.Left == -1 && boxBoxMaxDist2(&node1.Span,
+		&node2.Span) < b2 {
+		// Every point in one leaf is linked to every point in the other.
+		for j := node1.Start; j < node1.End; j++ {
+			union(parent, int64(j), int64(node2.Start))
+		}
+		for j := node2.Start; j < node2.End; j++ {
+			union(parent, int64(j), int64(node1.Start))
+		}
+		return
+	}
+
+	if nc := idx.NumChildren(i1); nc > 0 {
+		for c := 0; c < nc; c++ {
+			linkLeaf(idx, t, idx.Child(i1, c), i2, b2, parent)
+		}
+		return
+	}
+
+	for j2 := node2.Start; j2 < node2.End; j2++ {
+		start := node1.Start
+		if i1 == i2 { start = j2 + 1 }
+		for j1 := start; j1 < node1.End; j1++ {
+			if calcR2(&t.Points[j1], &t.Points[j2]) < b2 {
+				union(parent, int64(j1), int64(j2))
+			}
+		}
+	}
+}
+
+// boxBoxMaxDist2 returns the largest squared distance between a point in
+// box a and a point in box b.
+func boxBoxMaxDist2(a, b *[2][3]float64) float64 {
+	d2 := 0.0
+	for k := 0; k < 3; k++ {
+		dx := b[1][k] - a[0][k]
+		if dx2 := a[1][k] - b[0][k]; dx2 > dx { dx = dx2 }
+		d2 += dx*dx
+	}
+	return d2
+}
+
+// unionFind returns the root of i's set, halving the path to it. parent can
+// be modified by other goroutines.
+func unionFind(parent []int64, i int64) int64 {
+	for {
+		p := atomic.LoadInt64(&parent[i])
+		if p == i { return i }
+		gp := atomic.LoadInt64(&parent[p])
+		if gp != p { atomic.CompareAndSwapInt64(&parent[i], p, gp) }
+		i = p
+	}
+}
+
+// union joins the sets containing i and j. The root with the larger index is
+// always attached to the smaller one, so that concurrent unions can't form
+// cycles.
+func union(parent []int64, i, j int64) {
+	for {
+		ri, rj := unionFind(parent, i), unionFind(parent, j)
+		if ri == rj { return }
+		if ri < rj { ri, rj = rj, ri }
+		if atomic.CompareAndSwapInt64(&parent[ri], ri, rj) { return }
+	}
+}
@@ -0,0 +1,74 @@
+package gravitree
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// clusteredPoints returns a uniform background with several dense clumps.
+func clusteredPoints(n int) [][3]float64 {
+	x := randomPoints(n/4)
+	for len(x) < n {
+		c := [3]float64{ rand.Float64(), rand.Float64(), rand.Float64() }
+		sigma := 0.02*rand.Float64()
+		for j := 0; j < 50 + rand.Intn(300) && len(x) < n; j++ {
+			x = append(x, [3]float64{ c[0] + sigma*rand.NormFloat64(),
+				c[1] + sigma*rand.NormFloat64(), c[2] + sigma*rand.NormFloat64() })
+		}
+	}
+	return x
+}
+
+// bruteFoF finds FoF groups with an O(n^2) search and labels them in the
+// same way as FriendsOfFriends.
+func bruteFoF(x [][3]float64, b float64, minMembers int) *FoFGroups {
+	parent := make([]int64, len(x))
+	for i := range parent { parent[i] = int64(i) }
+	for i := range x {
+		for j := i + 1; j < len(x); j++ {
+			if calcR2(&x[i], &x[j]) < b*b { union(parent, int64(i), int64(j)) }
+		}
+	}
+
+	// Roots are the smallest member of each group.
+	size := make([]int, len(x))
+	for i := range x { size[unionFind(parent, int64(i))]++ }
+	roots := []int{ }
+	for r := range size {
+		if size[r] > 0 && size[r] >= minMembers { roots = append(roots, r) }
+	}
+	sort.SliceStable(roots, func(i, j int) bool {
+		return size[roots[i]] > size[roots[j]]
+	})
+
+	id := make([]int, len(x))
+	for i := range id { id[i] = -1 }
+	groups := &FoFGroups{ ID: make([]int, len(x)) }
+	for g, r := range roots {
+		id[r] = g
+		groups.Sizes = append(groups.Sizes, size[r])
+	}
+	for i := range x { groups.ID[i] = id[unionFind(parent, int64(i))] }
+	return groups
+}
+
+func TestFriendsOfFriends(t *testing.T) {
+	rand.Seed(25)
+	x := clusteredPoints(4000)
+
+	for _, b := range []float64{ 0, 0.005, 0.02, 0.05 } {
+		for _, minMembers := range []int{ 1, 10 } {
+			exp := bruteFoF(x, b, minMembers)
+			for _, tree := range []*Tree{ NewTree(x), &NewOctree(x).Tree } {
+				groups := tree.FriendsOfFriends(b, minMembers)
+				if !intsEqual(groups.Sizes, exp.Sizes) ||
+					!intsEqual(groups.ID, exp.ID) {
+					t.Errorf("b = %g, minMembers = %d: found %d groups, " +
+						"expected %d.", b, minMembers, len(groups.Sizes),
+						len(exp.Sizes))
+				}
+			}
+		}
+	}
+}
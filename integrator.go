@@ -192,6 +192,9 @@ func RK4Step(
 	}
 }
 
+// GetParticleCount returns the number of points in x within r of the origin.
+// Each call scans every point, so RadialProfile.EnclosedMass should be used
+// for repeated queries.
 func GetParticleCount(x [][3]float64, r float64) int {
 
 	count := 0
@@ -239,6 +242,9 @@ func CalculateEnergy(
 	return res
 }
 
+// GetCircularVelocity returns the circular velocity at r of the points in x.
+// Each call scans every point, so RadialProfile.GetCircularVelocity should be
+// used for repeated queries.
 func GetCircularVelocity(x [][3]float64, r, particleMass float64) float64 {
 	npart := float64(GetParticleCount(x, r))
 	return math.Sqrt(1. * npart * particleMass / r)
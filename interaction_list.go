@@ -0,0 +1,99 @@
+package gravitree
+
+import (
+	"fmt"
+)
+
+// InteractionKind identifies which Quantity method an interaction calls.
+type InteractionKind uint8
+
+const (
+	TwoSidedLeafInteraction InteractionKind = iota
+	OneSidedLeafInteraction
+	ApproximateInteraction
+)
+
+// InteractionList is a compact form of the calls recorded by a CallStructure.
+// It can be replayed against new Quantities, or against trees whose points
+// have been moved with ShiftNodes, without walking the tree again. This is
+// useful when evaluating several quantities or several timesteps with the same
+// tree topology. Note that the opening decisions are not re-checked during a
+// replay, so the accuracy of the result degrades as the points move.
+type InteractionList struct {
+	// The interactions of target node i in t2 are stored in the range
+	// [Offsets[i], Offsets[i+1]) of Sources and Kinds.
+	Offsets []int
+	Sources []int32 // The source node in t1 for each interaction.
+	Kinds []InteractionKind // The type of each interaction.
+
+	nodes1 int // Number of nodes in the t1 that the list was recorded with.
+}
+
+// InteractionList converts the calls recorded by cs into an InteractionList.
+func (cs *CallStructure) InteractionList() *InteractionList {
+	n2 := len(cs.Sizes2)
+	il := &InteractionList{ Offsets: make([]int, n2 + 1),
+		nodes1: len(cs.Sizes1) }
+
+	n := 0
+	for i := 0; i < n2; i++ {
+		n += len(cs.TwoSidedLeafCalls[i]) + len(cs.OneSidedLeafCalls[i]) +
+			len(cs.ApproximateCalls[i])
+	}
+	il.Sources = make([]int32, 0, n)
+	il.Kinds = make([]InteractionKind, 0, n)
+
+	for i := 0; i < n2; i++ {
+		il.Offsets[i] = len(il.Sources)
+		for _, c := range cs.TwoSidedLeafCalls[i] {
+			il.add(c.I1, TwoSidedLeafInteraction)
+		}
+		for _, c := range cs.OneSidedLeafCalls[i] {
+			il.add(c.I1, OneSidedLeafInteraction)
+		}
+		for _, c := range cs.ApproximateCalls[i] {
+			il.add(c.I1, ApproximateInteraction)
+		}
+	}
+	il.Offsets[n2] = len(il.Sources)
+
+	return il
+}
+
+func (il *InteractionList) add(source int, kind InteractionKind) {
+	il.Sources = append(il.Sources, int32(source))
+	il.Kinds = append(il.Kinds, kind)
+}
+
+// Len returns the number of interactions in the list.
+func (il *InteractionList) Len() int { return len(il.Sources) }
+
+// Replay evaluates q at the points in t2 using the points in t1 by re-applying
+// the recorded interactions. t1 and t2 must have the same topology as the
+// trees that the list was recorded with. If the list was recorded with
+// Evaluate, t1 and t2 should be the same tree.
+func (il *InteractionList) Replay(t1, t2 *Tree, eps float64, q Quantity) {
+	if len(t1.Nodes) != il.nodes1 || len(t2.Nodes) + 1 != len(il.Offsets) {
+		panic(fmt.Sprintf("InteractionList was recorded with trees that " +
+			"have %d and %d nodes, but the trees have %d and %d nodes.",
+			il.nodes1, len(il.Offsets) - 1, len(t1.Nodes), len(t2.Nodes)))
+	} else if q.Len() != len(t2.Points) {
+		panic(fmt.Sprintf("Tree has %d points, but len(q) = %d",
+			len(t2.Points), q.Len()))
+	}
+
+	t1.eps2 = eps * eps
+	WorkerQueue(nWorkers, len(t2.Nodes), func(worker, i2 int) {
+		for j := il.Offsets[i2]; j < il.Offsets[i2+1]; j++ {
+			i1 := int(il.Sources[j])
+			switch il.Kinds[j] {
+			case TwoSidedLeafInteraction:
+				q.TwoSidedLeaf(t1, i1)
+			case OneSidedLeafInteraction:
+				q.OneSidedLeaf(t1, t2, i1, i2)
+			case ApproximateInteraction:
+				q.Approximate(t1, t2, i1, i2)
+			}
+		}
+	})
+}
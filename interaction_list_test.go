@@ -0,0 +1,115 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func randomPoints(n int) [][3]float64 {
+	x := make([][3]float64, n)
+	for i := range x {
+		for k := 0; k < 3; k++ {
+			x[i][k] = rand.Float64()
+		}
+	}
+	return x
+}
+
+func maxRelDiff(x, y []float64) float64 {
+	max := 0.0
+	for i := range x {
+		d := math.Abs(x[i] - y[i]) / math.Abs(y[i])
+		if d > max { max = d }
+	}
+	return max
+}
+
+func TestInteractionListReplay(t *testing.T) {
+	rand.Seed(1)
+	x := randomPoints(2000)
+	tree := NewTree(x)
+
+	phi := make([]float64, len(x))
+	cs := NewCallStructure(tree, tree, Potential(phi))
+	tree.Evaluate(0.01, cs)
+	il := cs.InteractionList()
+
+	nCalls := 0
+	for i := range cs.ApproximateCalls {
+		nCalls += len(cs.ApproximateCalls[i]) + len(cs.OneSidedLeafCalls[i]) +
+			len(cs.TwoSidedLeafCalls[i])
+	}
+	if il.Len() != nCalls {
+		t.Errorf("Expected %d interactions, got %d.", nCalls, il.Len())
+	}
+
+	// Replaying the list should reproduce the walk.
+	phiReplay := make([]float64, len(x))
+	il.Replay(tree, tree, 0.01, Potential(phiReplay))
+	if d := maxRelDiff(phiReplay, phi); d > 1e-12 {
+		t.Errorf("Replayed potential differs from Evaluate by %g.", d)
+	}
+
+	// A small shift shouldn't change any opening decisions.
+	for i := range x {
+		for k := 0; k < 3; k++ {
+			x[i][k] += 1e-7*(rand.Float64() - 0.5)
+		}
+	}
+	tree.ShiftNodes(x)
+
+	phi = make([]float64, len(x))
+	tree.Evaluate(0.01, Potential(phi))
+	phiReplay = make([]float64, len(x))
+	il.Replay(tree, tree, 0.01, Potential(phiReplay))
+	if d := maxRelDiff(phiReplay, phi); d > 1e-12 {
+		t.Errorf("Replayed potential after ShiftNodes differs from " +
+			"Evaluate by %g.", d)
+	}
+}
+
+func TestInteractionListReplayAt(t *testing.T) {
+	rand.Seed(2)
+	x1, x2 := randomPoints(2000), randomPoints(100)
+	t1, t2 := NewTree(x1), NewTree(x2)
+
+	acc := make([][3]float64, len(x2))
+	cs := NewCallStructure(t1, t2, Acceleration(acc))
+	t1.EvaluateAt(t2, 0.01, cs)
+	il := cs.InteractionList()
+
+	accReplay := make([][3]float64, len(x2))
+	il.Replay(t1, t2, 0.01, Acceleration(accReplay))
+	if d := maxRelDiff(flatten3(accReplay), flatten3(acc)); d > 1e-12 {
+		t.Errorf("Replayed acceleration differs from EvaluateAt by %g.", d)
+	}
+}
+
+func TestShiftNodes(t *testing.T) {
+	rand.Seed(3)
+	x := randomPoints(1000)
+	tree := NewTree(x)
+
+	for i := range x {
+		x[i][0] += 0.01*rand.Float64()
+	}
+	tree.ShiftNodes(x)
+
+	for i := range tree.Points {
+		if tree.Points[i] != x[tree.Index[i]] {
+			t.Fatalf("Point %d was not updated by ShiftNodes.", i)
+		}
+	}
+
+	for i := range tree.Nodes {
+		node := &tree.Nodes[i]
+		pts := tree.Points[node.Start: node.End]
+		center := centerOfMass(pts)
+		_, rMax2 := rMax2(center, pts)
+		if node.Center != center || node.RMax2 != rMax2 {
+			t.Errorf("Node %d has center %.4f and RMax2 %.4f, but expected " +
+				"%.4f and %.4f.", i, node.Center, node.RMax2, center, rMax2)
+		}
+	}
+}
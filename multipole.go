@@ -0,0 +1,303 @@
+package gravitree
+
+import (
+	"math"
+)
+
+// The higher order moments of a node are the Cartesian tensors
+//
+//   M_a = sum_j (x_j - x_cm)^a
+//
+// where a = (a_x, a_y, a_z) is a multi-index and u^a = u_x^a_x u_y^a_y u_z^a_z.
+// The degree of a is |a| = a_x + a_y + a_z. The potential of a node at a
+// displacement d from its center of mass is then
+//
+//   phi(d) = -sum_a (-1)^|a| / a! M_a D^a f(d)
+//
+// where f(d) = (|d|^2 + eps^2)^(-1/2) and D^a is the corresponding partial
+// derivative. The degree-1 moments vanish about the center of mass, so an
+// expansion of order n (n = 0 for a monopole) keeps the terms with |a| <= n+1.
+// Moments are stored for 2 <= |a| <= n+1, with a node's moments packed in the
+// multi-index order below.
+
+// maxMultipoleDegree is the highest degree of a stored moment.
+const maxMultipoleDegree = int(Hexadecapole) + 1
+
+// maxDerivativeDegree is the highest degree of a derivative of f used by the
+// kernels. Accelerations need one more derivative than potentials.
+const maxDerivativeDegree = maxMultipoleDegree + 1
+
+var (
+	// multiIndices lists every multi-index with degree up to
+	// maxDerivativeDegree, ordered by degree.
+	multiIndices [][3]int
+	// multiIndexStart[n] is the index of the first degree-n multi-index.
+	multiIndexStart [maxDerivativeDegree + 2]int
+	// multiIndexID[a_x][a_y][a_z] is the index of a multi-index.
+	multiIndexID [maxDerivativeDegree + 1][maxDerivativeDegree + 1][maxDerivativeDegree + 1]int
+	// multiIndexUp[i][k] is the index of multiIndices[i] + e_k.
+	multiIndexUp [][3]int
+	// derivativeTerms[i] are the terms of D^a f for a = multiIndices[i].
+	derivativeTerms [][]derivativeTerm
+	// multipoleFactor[i] is (-1)^|a| / a! for a = multiIndices[i].
+	multipoleFactor []float64
+)
+
+// derivativeTerm is one term of a partial derivative of f:
+//
+//   Coef d^Pow h_H
+//
+// where h_n = (-1)^n (2n - 1)!! (|d|^2 + eps^2)^(-(2n+1)/2) is the n-th
+// derivative of f with respect to |d|^2/2.
+type derivativeTerm struct {
+	Coef float64
+	Pow [3]int
+	H int
+}
+
+func init() {
+	for n := 0; n <= maxDerivativeDegree; n++ {
+		multiIndexStart[n] = len(multiIndices)
+		for ax := n; ax >= 0; ax-- {
+			for ay := n - ax; ay >= 0; ay-- {
+				a := [3]int{ ax, ay, n - ax - ay }
+				multiIndexID[a[0]][a[1]][a[2]] = len(multiIndices)
+				multiIndices = append(multiIndices, a)
+			}
+		}
+	}
+	multiIndexStart[maxDerivativeDegree + 1] = len(multiIndices)
+
+	multiIndexUp = make([][3]int, len(multiIndices))
+	derivativeTerms = make([][]derivativeTerm, len(multiIndices))
+	multipoleFactor = make([]float64, len(multiIndices))
+	for i, a := range multiIndices {
+		multipoleFactor[i] = 1 / (factorial(a[0])*factorial(a[1])*
+			factorial(a[2]))
+		if (a[0] + a[1] + a[2]) % 2 == 1 { multipoleFactor[i] *= -1 }
+
+		for k := 0; k < 3; k++ {
+			up := a
+			up[k]++
+			if up[0] + up[1] + up[2] <= maxDerivativeDegree {
+				multiIndexUp[i][k] = multiIndexID[up[0]][up[1]][up[2]]
+			} else {
+				multiIndexUp[i][k] = -1
+			}
+		}
+		derivativeTerms[i] = derivativeTermsOf(a)
+	}
+}
+
+// derivativeTermsOf expands D^a f. Each dimension contributes
+//
+//   a_k! / (2^m m! (a_k - 2m)!) d_k^(a_k - 2m)
+//
+// for every 0 <= m <= a_k/2, and a term with sum_k m_k = m uses h_(|a| - m).
+func derivativeTermsOf(a [3]int) []derivativeTerm {
+	n := a[0] + a[1] + a[2]
+	terms := []derivativeTerm{ }
+	for mx := 0; 2*mx <= a[0]; mx++ {
+		for my := 0; 2*my <= a[1]; my++ {
+			for mz := 0; 2*mz <= a[2]; mz++ {
+				m := [3]int{ mx, my, mz }
+				term := derivativeTerm{ Coef: 1, H: n - mx - my - mz }
+				for k := 0; k < 3; k++ {
+					term.Pow[k] = a[k] - 2*m[k]
+					term.Coef *= factorial(a[k]) / (math.Pow(2, float64(m[k])) *
+						factorial(m[k]) * factorial(a[k] - 2*m[k]))
+				}
+				terms = append(terms, term)
+			}
+		}
+	}
+	return terms
+}
+
+func factorial(n int) float64 {
+	out := 1.0
+	for i := 2; i <= n; i++ { out *= float64(i) }
+	return out
+}
+
+func binomial(n, k int) float64 {
+	return factorial(n) / (factorial(k) * factorial(n - k))
+}
+
+// multipoleDegree returns the highest moment degree needed by a tree with
+// the given order.
+func multipoleDegree(order ApproximationOrder) int {
+	if order == Adaptive { order = maxAdaptiveOrder }
+	return int(order) + 1
+}
+
+// multipoleStride returns the number of moments stored per node for moments
+// up to a given degree.
+func multipoleStride(degree int) int {
+	if degree < 2 { return 0 }
+	return multiIndexStart[degree + 1] - multiIndexStart[2]
+}
+
+// computeMultipoles computes the moments of every node up to the tree's
+// degree. Leaf moments are summed directly and the moments of every other
+// node are found by shifting the moments of its children to its center of
+// mass.
+func computeMultipoles(idx SpatialIndex) {
+	t := idx.Base()
+	degree := multipoleDegree(t.Order)
+	stride := multipoleStride(degree)
+	t.Multipoles = append(t.Multipoles[:0],
+		make([]float64, stride*len(t.Nodes))...)
+	if stride == 0 { return }
+
+	// Children always have larger indices than their parents.
+	for i := len(t.Nodes) - 1; i >= 0; i-- {
+		node := &t.Nodes[i]
+		m := t.Multipoles[i*stride: (i+1)*stride]
+		if node.Left == -1 {
+			for j := node.Start; j < node.End; j++ {
+				addShiftedMoments(m, nil, 1, &node.Center, &t.Points[j], degree)
+			}
+		} else {
+			for c, n := 0, idx.NumChildren(i); c < n; c++ {
+				ic := idx.Child(i, c)
+				child := &t.Nodes[ic]
+				mc := t.Multipoles[ic*stride: (ic+1)*stride]
+				mass := float64(child.End - child.Start)
+				addShiftedMoments(m, mc, mass, &node.Center, &child.Center,
+					degree)
+			}
+		}
+	}
+}
+
+// addShiftedMoments adds the moments, mc, of a set of points with the given
+// mass and center of mass, x, to the moments, m, of a node centered on c.
+// If mc is nil, the points are treated as a single point mass.
+func addShiftedMoments(
+	m, mc []float64, mass float64, c, x *[3]float64, degree int,
+) {
+	s := [3]float64{ x[0] - c[0], x[1] - c[1], x[2] - c[2] }
+	pow := [3][maxMultipoleDegree + 1]float64{ }
+	for k := 0; k < 3; k++ {
+		pow[k][0] = 1
+		for n := 1; n <= degree; n++ { pow[k][n] = pow[k][n-1]*s[k] }
+	}
+
+	offset := multiIndexStart[2]
+	for i := offset; i < multiIndexStart[degree + 1]; i++ {
+		a := multiIndices[i]
+		sum := mass*pow[0][a[0]]*pow[1][a[1]]*pow[2][a[2]]
+
+		if mc != nil {
+			// M'_a = sum_(b <= a) binom(a, b) s^(a - b) M_b, where the
+			// degree-0 moment is the mass and degree-1 moments vanish.
+			for bx := 0; bx <= a[0]; bx++ {
+				for by := 0; by <= a[1]; by++ {
+					for bz := 0; bz <= a[2]; bz++ {
+						if bx + by + bz < 2 { continue }
+						j := multiIndexID[bx][by][bz] - offset
+						sum += binomial(a[0], bx)*binomial(a[1], by)*
+							binomial(a[2], bz)*mc[j]*pow[0][a[0] - bx]*
+							pow[1][a[1] - by]*pow[2][a[2] - bz]
+					}
+				}
+			}
+		}
+
+		m[i - offset] += sum
+	}
+}
+
+// multipoleKernel evaluates the expansion of node i1 of t1 with the given
+// order at target points.
+type multipoleKernel struct {
+	mass float64
+	center *[3]float64
+	eps2 float64
+	degree int
+	// w[i] = (-1)^|a| / a! M_a for a = multiIndices[i + multiIndexStart[2]].
+	w [maxMultipoleWeights]float64
+}
+
+const maxMultipoleWeights = 31 // multipoleStride(maxMultipoleDegree)
+
+func newMultipoleKernel(
+	t1 *Tree, i1 int, order ApproximationOrder,
+) multipoleKernel {
+	node := &t1.Nodes[i1]
+	stride := multipoleStride(multipoleDegree(t1.Order))
+	m := t1.Multipoles[i1*stride: (i1+1)*stride]
+
+	k := multipoleKernel{ mass: float64(node.End - node.Start),
+		center: &node.Center, eps2: t1.eps2, degree: int(order) + 1 }
+
+	offset := multiIndexStart[2]
+	for i := offset; i < multiIndexStart[k.degree + 1]; i++ {
+		k.w[i - offset] = multipoleFactor[i] * m[i - offset]
+	}
+
+	return k
+}
+
+// derivatives computes the powers of d = x - x_cm and the derivatives h_n
+// needed to evaluate D^a f at x.
+func (k *multipoleKernel) derivatives(
+	x *[3]float64,
+) (d [3]float64, pow [3][maxDerivativeDegree + 1]float64,
+	h [maxDerivativeDegree + 1]float64) {
+
+	r2 := k.eps2
+	for j := 0; j < 3; j++ {
+		d[j] = x[j] - k.center[j]
+		r2 += d[j]*d[j]
+		pow[j][0] = 1
+		for n := 1; n <= k.degree + 1; n++ { pow[j][n] = pow[j][n-1]*d[j] }
+	}
+
+	h[0] = 1 / math.Sqrt(r2)
+	for n := 1; n <= k.degree + 1; n++ {
+		h[n] = -float64(2*n - 1) * h[n-1] / r2
+	}
+
+	return d, pow, h
+}
+
+// derivative returns D^a f for a = multiIndices[i].
+func derivative(
+	i int, pow *[3][maxDerivativeDegree + 1]float64,
+	h *[maxDerivativeDegree + 1]float64,
+) float64 {
+	sum := 0.0
+	for _, term := range derivativeTerms[i] {
+		sum += term.Coef * pow[0][term.Pow[0]] * pow[1][term.Pow[1]] *
+			pow[2][term.Pow[2]] * h[term.H]
+	}
+	return sum
+}
+
+// potential returns the potential of the expansion at x.
+func (k *multipoleKernel) potential(x *[3]float64) float64 {
+	_, pow, h := k.derivatives(x)
+
+	phi := k.mass * h[0]
+	offset := multiIndexStart[2]
+	for i := offset; i < multiIndexStart[k.degree + 1]; i++ {
+		phi += k.w[i - offset] * derivative(i, &pow, &h)
+	}
+	return -phi
+}
+
+// acceleration adds the acceleration of the expansion at x to acc.
+func (k *multipoleKernel) acceleration(x *[3]float64, acc *[3]float64) {
+	d, pow, h := k.derivatives(x)
+
+	offset := multiIndexStart[2]
+	for j := 0; j < 3; j++ {
+		a := k.mass * d[j] * h[1]
+		for i := offset; i < multiIndexStart[k.degree + 1]; i++ {
+			a += k.w[i - offset] * derivative(multiIndexUp[i][j], &pow, &h)
+		}
+		acc[j] += a
+	}
+}
@@ -0,0 +1,117 @@
+package gravitree
+
+// Octree is a Barnes-Hut octree (Barnes & Hut 1986) which can be used in
+// place of the k-d Tree. The root is the smallest cube containing every
+// point, and each node is split into its eight octants until it holds
+// LeafSize points or fewer. Empty octants are dropped. Octrees are shallower
+// than k-d trees, but their nodes are less balanced and they have more
+// nodes with few points.
+//
+// The nodes, points, and moments are stored in the embedded Tree, so an
+// Octree can be used anywhere that the nodes of a *Tree are read, e.g. as the
+// target of Tree.EvaluateAt or by a Quantity. Tree methods walk the octree's
+// children through its SpatialIndex, so they can be called on an Octree or on
+// its embedded Tree, &ot.Tree. The children of node i are the
+// contiguous nodes Nodes[i].Left through Nodes[i].Right. Nodes have the same
+// bounding boxes (Node.Span) as k-d nodes, and opening criteria see these
+// boxes rather than the nodes' cubes.
+type Octree struct {
+	Tree
+}
+
+var _ SpatialIndex = &Octree{ } // type-checking
+
+// maxOctreeDepth is the depth at which nodes become leaves regardless of how
+// many points they hold. This keeps duplicate points from splitting forever.
+const maxOctreeDepth = 48
+
+// NewOctree creates an Octree from a collection of vectors, x. It uses
+// TreeOptions in the same way as NewTree.
+func NewOctree(x [][3]float64, opt ...TreeOptions) *Octree {
+	t, o := newEmptyTree(x, opt)
+	ot := &Octree{ Tree: *t }
+	ot.index = ot
+	if len(x) == 0 { return ot }
+
+	span := pointSpan(ot.Points)
+	center, width := [3]float64{ }, 0.0
+	for k := 0; k < 3; k++ {
+		center[k] = (span[0][k] + span[1][k]) / 2
+		if dx := span[1][k] - span[0][k]; dx > width { width = dx }
+	}
+
+	ot.addOctreeNode(0, len(x))
+	ot.splitOctreeNode(0, 0, center, width/2)
+	ot.Root = &ot.Nodes[0]
+
+	ot.allocateMoments(o)
+	computeMoments(ot)
+
+	return ot
+}
+
+// addOctreeNode adds a leaf to the tree which corresponds to points in the
+// range [start: end].
+func (ot *Octree) addOctreeNode(start, end int) {
+	span := pointSpan(ot.Points[start: end])
+	blankNode := Node{ [3]float64{}, 0, 0, 0, -1, -1, start, end, span }
+
+	i := len(ot.Nodes)
+	ot.Nodes = append(ot.Nodes, blankNode)
+	ot.Nodes[i].ROpen2 = ot.rOpen2(i, span)
+}
+
+// splitOctreeNode recursively splits node i, which has the given depth and
+// is a cube with the given center and half-width, into its octants.
+func (ot *Octree) splitOctreeNode(
+	i, depth int, center [3]float64, halfWidth float64,
+) {
+	start, end := ot.Nodes[i].Start, ot.Nodes[i].End
+	if end - start <= ot.LeafSize || depth >= maxOctreeDepth ||
+		halfWidth == 0 { return }
+
+	// bounds[j] is the start of octant j. Points are split along z, then y,
+	// then x, so octant j has bit k set if it's on the high side of
+	// dimension k.
+	bounds := [9]int{ }
+	bounds[0], bounds[8] = start, end
+	for k, step := 0, 8; k < 3; k, step = k+1, step/2 {
+		for j := 0; j < 8; j += step {
+			lo, hi := bounds[j], bounds[j + step]
+			mid := partition(ot.Points[lo: hi], ot.Index[lo: hi], 2 - k,
+				center[2 - k])
+			bounds[j + step/2] = lo + mid
+		}
+	}
+
+	// Children are added in a block so that they're contiguous.
+	first := len(ot.Nodes)
+	octants := []int{ }
+	for j := 0; j < 8; j++ {
+		if bounds[j] == bounds[j + 1] { continue }
+		ot.addOctreeNode(bounds[j], bounds[j + 1])
+		octants = append(octants, j)
+	}
+	ot.Nodes[i].Left, ot.Nodes[i].Right = first, len(ot.Nodes) - 1
+
+	for c, j := range octants {
+		childCenter := center
+		for k := 0; k < 3; k++ {
+			if j & (1 << k) != 0 {
+				childCenter[k] += halfWidth/2
+			} else {
+				childCenter[k] -= halfWidth/2
+			}
+		}
+		ot.splitOctreeNode(first + c, depth + 1, childCenter, halfWidth/2)
+	}
+}
+
+// NumChildren returns the number of non-empty octants of node i.
+func (ot *Octree) NumChildren(i int) int {
+	if ot.Nodes[i].Left == -1 { return 0 }
+	return ot.Nodes[i].Right - ot.Nodes[i].Left + 1
+}
+
+// Child returns the j-th non-empty octant of node i.
+func (ot *Octree) Child(i, j int) int { return ot.Nodes[i].Left + j }
@@ -0,0 +1,115 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestOctreeStructure(t *testing.T) {
+	rand.Seed(15)
+	x := normalPoints(5000)
+	// Duplicate points can't be split, so they stop at maxOctreeDepth.
+	for i := 0; i < 40; i++ { x = append(x, [3]float64{ 1, 1, 1 }) }
+	ot := NewOctree(x, TreeOptions{ LeafSize: 8 })
+
+	for i := range ot.Nodes {
+		node := &ot.Nodes[i]
+		n := ot.NumChildren(i)
+		if n == 0 {
+			if node.End - node.Start > ot.LeafSize &&
+				calcR2(&node.Span[0], &node.Span[1]) > 0 {
+				t.Fatalf("Leaf %d has %d distinct points.",
+					i, node.End - node.Start)
+			}
+			continue
+		} else if n > 8 {
+			t.Fatalf("Node %d has %d children.", i, n)
+		}
+
+		// Children must be non-empty and cover the node's points in order.
+		start := node.Start
+		for c := 0; c < n; c++ {
+			child := &ot.Nodes[ot.Child(i, c)]
+			if ot.Child(i, c) <= i || child.Start != start ||
+				child.End <= child.Start {
+				t.Fatalf("Child %d of node %d is [%d, %d), expected a " +
+					"range starting at %d.", c, i, child.Start, child.End,
+					start)
+			}
+			start = child.End
+		}
+		if start != node.End {
+			t.Fatalf("Children of node %d end at %d, not %d.",
+				i, start, node.End)
+		}
+	}
+}
+
+func TestOctreeEvaluate(t *testing.T) {
+	rand.Seed(16)
+	x := normalPoints(3000)
+	eps := 0.01
+
+	ot := NewOctree(x, TreeOptions{ Criteria: directCriteria{ } })
+	phi, phiBrute := make([]float64, len(x)), make([]float64, len(x))
+	ot.Evaluate(eps, Potential(phi))
+	BruteForcePotential(eps, x, phiBrute)
+	if diff := maxRelDiff(phi, phiBrute); diff > 1e-9 {
+		t.Errorf("Unapproximated octree potential differs from brute " +
+			"force by %g.", diff)
+	}
+	// The embedded Tree should walk the octree's children.
+	phiEmbed := make([]float64, len(x))
+	ot.Tree.Evaluate(eps, Potential(phiEmbed))
+	if diff := maxRelDiff(phiEmbed, phiBrute); diff > 1e-9 {
+		t.Errorf("Octree potential through &ot.Tree differs from brute " +
+			"force by %g.", diff)
+	}
+
+	for _, order := range []ApproximationOrder{ Monopole, Quadrupole } {
+		ot := NewOctree(x, TreeOptions{ Order: order, Theta: 0.5 })
+		acc := make([][3]float64, len(x))
+		ot.Evaluate(eps, Acceleration(acc))
+		err := ot.AuditAcceleration(eps, acc, 300, 0)
+		if err.P99 > 3e-2 {
+			t.Errorf("Octree with order %d gave errors %s.", order, err)
+		}
+	}
+
+	// EvaluateAt on test points should agree with the k-d tree.
+	y := normalPoints(500)
+	t2 := NewTree(y)
+	phiOct, phiKD := make([]float64, len(y)), make([]float64, len(y))
+	NewOctree(x, TreeOptions{ Criteria: directCriteria{ } }).EvaluateAt(
+		t2, eps, Potential(phiOct))
+	NewTree(x, TreeOptions{ Criteria: directCriteria{ } }).EvaluateAt(
+		t2, eps, Potential(phiKD))
+	if diff := maxRelDiff(phiOct, phiKD); diff > 1e-9 {
+		t.Errorf("Octree and k-d EvaluateAt differ by %g.", diff)
+	}
+}
+
+func TestOctreeSearchSphere(t *testing.T) {
+	rand.Seed(17)
+	x := randomPoints(2000)
+	ot := NewOctree(x)
+
+	for _, r := range []float64{ 0.05, 0.25, 2 } {
+		pt := [3]float64{ 0.4, 0.5, 0.6 }
+		found := make([]bool, len(x))
+		for _, i := range ot.SearchSphere(pt, r) { found[i] = true }
+		if n := len((&ot.Tree).SearchSphere(pt, r)); n != len(
+			ot.SearchSphere(pt, r)) {
+			t.Errorf("r = %g: &ot.Tree found %d points, expected %d.",
+				r, n, len(ot.SearchSphere(pt, r)))
+		}
+
+		for i := range x {
+			if inR := math.Sqrt(calcR2(&pt, &x[i])) < r; inR != found[i] {
+				t.Fatalf("r = %g: point %d has distance %g, but found = %v.",
+					r, i, math.Sqrt(calcR2(&pt, &x[i])), found[i])
+			}
+		}
+	}
+}
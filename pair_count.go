@@ -0,0 +1,293 @@
+package gravitree
+
+import (
+	"fmt"
+	"math"
+)
+
+// PairCountOptions customizes PairCount. Zero values are replaced by their
+// defaults.
+type PairCountOptions struct {
+	// Box[k] is the width of a periodic box in dimension k. Points must be
+	// in [0, Box[k]) and the nearest periodic image of each pair is used.
+	// Dimensions with Box[k] = 0 aren't periodic. Default: no periodic
+	// dimensions.
+	Box [3]float64
+}
+
+// LogBins returns n + 1 logarithmically spaced bin edges from rMin to rMax.
+func LogBins(rMin, rMax float64, n int) []float64 {
+	if rMin <= 0 || rMax <= rMin || n <= 0 {
+		panic(fmt.Sprintf("Invalid log bins: rMin = %g, rMax = %g, n = %d.",
+			rMin, rMax, n))
+	}
+	edges := make([]float64, n + 1)
+	dlr := math.Log(rMax/rMin) / float64(n)
+	for b := range edges { edges[b] = rMin*math.Exp(dlr*float64(b)) }
+	edges[n] = rMax
+	return edges
+}
+
+// PairCount counts the pairs of points whose separations are in each of the
+// bins [edges[b], edges[b+1]). If t2 is nil or t, each distinct pair of
+// points in t is counted once. Otherwise, the pairs with one point in t and
+// the other in t2 are counted.
+//
+// Pairs of nodes are walked together, and every pair of nodes whose points
+// all fall in a single bin is counted at once, without looking at its
+// points. The first tree is split between workers.
+func (t *Tree) PairCount(
+	t2 *Tree, edges []float64, opt ...PairCountOptions,
+) []int {
+	if t2 == nil { t2 = t }
+	return pairCount(t.spatialIndex(), t2.spatialIndex(), edges, opt...)
+}
+
+// pairCount is the same as PairCount, except that it walks any pair of
+// SpatialIndexes.
+func pairCount(
+	idx1, idx2 SpatialIndex, edges []float64, opt ...PairCountOptions,
+) []int {
+	if len(edges) < 2 {
+		panic(fmt.Sprintf("At least two bin edges are needed, got %d.",
+			len(edges)))
+	}
+	edges2 := make([]float64, len(edges))
+	for b := range edges {
+		if edges[b] < 0 || (b > 0 && edges[b] <= edges[b - 1]) {
+			panic(fmt.Sprintf("Bin edges must be non-negative and " +
+				"increasing, got %v.", edges))
+		}
+		edges2[b] = edges[b]*edges[b]
+	}
+
+	pc := &pairCounter{ idx1: idx1, idx2: idx2, t1: idx1.Base(),
+		t2: idx2.Base(), self: idx1.Base() == idx2.Base(), edges2: edges2 }
+	if len(opt) > 0 { pc.box = opt[0].Box }
+	for k := 0; k < 3; k++ {
+		if pc.box[k] < 0 {
+			panic(fmt.Sprintf("Box widths must be non-negative, got %v.",
+				pc.box))
+		}
+	}
+
+	counts := make([]int, len(edges) - 1)
+	if len(pc.t1.Nodes) == 0 || len(pc.t2.Nodes) == 0 { return counts }
+	pc.checkBox(pc.t1)
+	pc.checkBox(pc.t2)
+
+	// Each worker walks the second tree from the root with small subtrees of
+	// the first.
+	tasks := pairCountTasks(idx1, 0, len(pc.t1.Points)/(16*nWorkers), nil)
+	workerCounts := make([][]int, nWorkers)
+	for w := range workerCounts { workerCounts[w] = make([]int, len(counts)) }
+	WorkerQueue(nWorkers, len(tasks), func(worker, j int) {
+		pc.count(tasks[j], 0, workerCounts[worker])
+	})
+
+	for w := range workerCounts {
+		for b := range counts { counts[b] += workerCounts[w][b] }
+	}
+	return counts
+}
+
+// pairCountTasks appends the nodes below i which have at most n points, or
+// which are leaves, to buf.
+func pairCountTasks(idx SpatialIndex, i, n int, buf []int) []int {
+	node := &idx.Base().Nodes[i]
+	nc := idx.NumChildren(i)
+	if nc == 0 || node.End - node.Start <= n { return append(buf, i) }
+	for c := 0; c < nc; c++ {
+		buf = pairCountTasks(idx, idx.Child(i, c), n, buf)
+	}
+	return buf
+}
+
+// pairCounter holds the state of a PairCount call.
+type pairCounter struct {
+	idx1, idx2 SpatialIndex
+	t1, t2 *Tree
+	self bool // Count distinct pairs within one tree.
+	edges2 []float64 // Squared bin edges.
+	box [3]float64
+}
+
+// checkBox panics if t has points outside the periodic box.
+func (pc *pairCounter) checkBox(t *Tree) {
+	span := &t.Nodes[0].Span
+	for k := 0; k < 3; k++ {
+		if pc.box[k] > 0 && (span[0][k] < 0 || span[1][k] >= pc.box[k]) {
+			panic(fmt.Sprintf("Points span %g to %g in dimension %d, " +
+				"outside the periodic box, [0, %g).", span[0][k], span[1][k],
+				k, pc.box[k]))
+		}
+	}
+}
+
+// count adds the pairs between nodes i1 and i2 to counts. When counting
+// pairs within one tree, only pairs where the first point comes before the
+// second in t.Points are counted.
+func (pc *pairCounter) count(i1, i2 int, counts []int) {
+	node1, node2 := &pc.t1.Nodes[i1], &pc.t2.Nodes[i2]
+	overlap := false
+	if pc.self {
+		if node2.End <= node1.Start { return }
+		overlap = node2.Start < node1.End
+	}
+
+	min2, max2, wrap := pc.boxDist2(&node1.Span, &node2.Span)
+	e2 := pc.edges2
+	if min2 >= e2[len(e2) - 1] || max2 < e2[0] { return }
+
+	// All the pairs fall in one bin.
+	if b := pc.bin(min2); b != -1 && b == pc.bin(max2) {
+		n1, n2 := node1.End - node1.Start, node2.End - node2.Start
+		if !overlap {
+			counts[b] += n1*n2
+			return
+		} else if i1 == i2 {
+			counts[b] += n1*(n1 - 1)/2
+			return
+		}
+	}
+
+	nc1, nc2 := pc.idx1.NumChildren(i1), pc.idx2.NumChildren(i2)
+	if nc1 == 0 && nc2 == 0 {
+		// Only the bins between min2 and max2 need to be searched.
+		lo, hi := pc.bin(min2), pc.bin(max2)
+		if lo == -1 { lo = 0 }
+		if hi == -1 { hi = len(e2) - 2 }
+		pc.countPoints(node1, node2, overlap, wrap, lo, hi + 1, counts)
+		return
+	}
+
+	// Split the larger node.
+	if nc2 == 0 || (nc1 > 0 && node1.End - node1.Start >=
+		node2.End - node2.Start) {
+		for c := 0; c < nc1; c++ { pc.count(pc.idx1.Child(i1, c), i2, counts) }
+	} else {
+		for c := 0; c < nc2; c++ { pc.count(i1, pc.idx2.Child(i2, c), counts) }
+	}
+}
+
+// countPoints counts the pairs between two leaves point by point. Only
+// distances in the bins [lo, hi) are counted. Periodic images are only
+// checked if wrap is true.
+func (pc *pairCounter) countPoints(
+	node1, node2 *Node, overlap, wrap bool, lo, hi int, counts []int,
+) {
+	e2 := pc.edges2
+	rMin2, rMax2 := e2[lo], e2[hi]
+	for j1 := node1.Start; j1 < node1.End; j1++ {
+		start := node2.Start
+		if overlap && start <= j1 { start = j1 + 1 }
+		x1 := &pc.t1.Points[j1]
+		for j2 := start; j2 < node2.End; j2++ {
+			x2 := &pc.t2.Points[j2]
+			var r2 float64
+			if wrap {
+				r2 = periodicR2(x1, x2, &pc.box)
+			} else {
+				r2 = calcR2(x1, x2)
+			}
+			if r2 < rMin2 || r2 >= rMax2 { continue }
+			counts[searchBins(e2, lo, hi, r2)]++
+		}
+	}
+}
+
+// bin returns the bin containing the squared distance r2, or -1 if it's
+// outside all the bins.
+func (pc *pairCounter) bin(r2 float64) int {
+	e2 := pc.edges2
+	if r2 < e2[0] || r2 >= e2[len(e2) - 1] { return -1 }
+	return searchBins(e2, 0, len(e2) - 1, r2)
+}
+
+// searchBins returns the bin b in [lo, hi) with e2[b] <= r2 < e2[b+1]. r2
+// must be in [e2[lo], e2[hi]).
+func searchBins(e2 []float64, lo, hi int, r2 float64) int {
+	for hi - lo > 1 {
+		mid := (lo + hi) / 2
+		if r2 < e2[mid] {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return lo
+}
+
+// boxDist2 returns lower and upper bounds on the squared distance between
+// points in the boxes a and b, using the nearest periodic images. wrap is
+// true if some pairs of points may be closer through the periodic boundary.
+func (pc *pairCounter) boxDist2(
+	a, b *[2][3]float64,
+) (min2, max2 float64, wrap bool) {
+	for k := 0; k < 3; k++ {
+		lo := math.Max(b[0][k] - a[1][k], a[0][k] - b[1][k])
+		if lo < 0 { lo = 0 }
+		hi := math.Max(b[1][k] - a[0][k], a[1][k] - b[0][k])
+		if L := pc.box[k]; L > 0 {
+			// The farthest pair in the box is the closest through the
+			// boundary.
+			if hi > L/2 {
+				lo, hi, wrap = math.Min(lo, L - hi), L/2, true
+			}
+		}
+		min2 += lo*lo
+		max2 += hi*hi
+	}
+	return min2, max2, wrap
+}
+
+// periodicR2 returns the squared distance between the nearest periodic images
+// of x1 and x2.
+func periodicR2(x1, x2 *[3]float64, box *[3]float64) float64 {
+	r2 := 0.0
+	for k := 0; k < 3; k++ {
+		dx := math.Abs(x1[k] - x2[k])
+		if box[k] > 0 && dx > box[k]/2 { dx = box[k] - dx }
+		r2 += dx*dx
+	}
+	return r2
+}
+
+// LandySzalay returns the Landy & Szalay (1993) estimate of the correlation
+// function, (DD - 2DR + RR)/RR, where the pair counts are normalized by the
+// number of possible pairs. dd and rr are counts within nD data points and
+// nR random points, and dr is the count between them. Bins without random
+// pairs are NaN.
+func LandySzalay(dd, dr, rr []int, nD, nR int) []float64 {
+	if len(dd) != len(dr) || len(dd) != len(rr) {
+		panic(fmt.Sprintf("len(dd) = %d, len(dr) = %d, and len(rr) = %d " +
+			"must be equal.", len(dd), len(dr), len(rr)))
+	}
+	normDD := float64(nD)*float64(nD - 1)/2
+	normDR := float64(nD)*float64(nR)
+	normRR := float64(nR)*float64(nR - 1)/2
+
+	xi := make([]float64, len(dd))
+	for b := range xi {
+		if rr[b] == 0 {
+			xi[b] = math.NaN()
+			continue
+		}
+		fDD, fDR := float64(dd[b])/normDD, float64(dr[b])/normDR
+		fRR := float64(rr[b])/normRR
+		xi[b] = (fDD - 2*fDR + fRR)/fRR
+	}
+	return xi
+}
+
+// CorrelationFunction returns the Landy-Szalay estimate of the two-point
+// correlation function of the points in t in the bins given by edges, using
+// the points in randoms as a random catalog.
+func (t *Tree) CorrelationFunction(
+	randoms *Tree, edges []float64, opt ...PairCountOptions,
+) []float64 {
+	dd := t.PairCount(nil, edges, opt...)
+	dr := t.PairCount(randoms, edges, opt...)
+	rr := randoms.PairCount(nil, edges, opt...)
+	return LandySzalay(dd, dr, rr, len(t.Points), len(randoms.Points))
+}
@@ -0,0 +1,93 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// brutePairCount counts pairs in the same way as PairCount with an O(n^2)
+// loop. If x2 is nil, distinct pairs within x1 are counted.
+func brutePairCount(
+	x1, x2 [][3]float64, edges []float64, box [3]float64,
+) []int {
+	counts := make([]int, len(edges) - 1)
+	for i := range x1 {
+		y, start := x2, 0
+		if x2 == nil { y, start = x1, i + 1 }
+		for j := start; j < len(y); j++ {
+			r := math.Sqrt(periodicR2(&x1[i], &y[j], &box))
+			for b := 0; b < len(counts); b++ {
+				if r >= edges[b] && r < edges[b + 1] { counts[b]++ }
+			}
+		}
+	}
+	return counts
+}
+
+func TestPairCount(t *testing.T) {
+	rand.Seed(47)
+	x1, x2 := clusteredPoints(2000), randomPoints(1500)
+	for i := range x1 {
+		for k := 0; k < 3; k++ { x1[i][k] = math.Mod(x1[i][k] + 1, 1) }
+	}
+
+	edges := append([]float64{ 0 }, LogBins(0.003, 0.6, 12)...)
+	boxes := [][3]float64{ { }, { 1, 1, 1 }, { 1, 0, 1 } }
+	for _, box := range boxes {
+		opt := PairCountOptions{ Box: box }
+		exp11 := brutePairCount(x1, nil, edges, box)
+		exp12 := brutePairCount(x1, x2, edges, box)
+
+		t1, t2 := NewTree(x1), NewTree(x2)
+		if counts := t1.PairCount(nil, edges, opt); !intsEqual(counts, exp11) {
+			t.Errorf("box = %v: Tree self counts = %v, expected %v.",
+				box, counts, exp11)
+		}
+		if counts := t1.PairCount(t2, edges, opt); !intsEqual(counts, exp12) {
+			t.Errorf("box = %v: Tree cross counts = %v, expected %v.",
+				box, counts, exp12)
+		}
+
+		ot1, ot2 := NewOctree(x1), NewOctree(x2)
+		if counts := ot1.PairCount(nil, edges, opt); !intsEqual(counts, exp11) {
+			t.Errorf("box = %v: Octree self counts = %v, expected %v.",
+				box, counts, exp11)
+		}
+		counts := ot1.PairCount(&ot2.Tree, edges, opt)
+		if !intsEqual(counts, exp12) {
+			t.Errorf("box = %v: Octree cross counts = %v, expected %v.",
+				box, counts, exp12)
+		}
+	}
+}
+
+func TestCorrelationFunction(t *testing.T) {
+	rand.Seed(48)
+	edges := LogBins(0.02, 0.2, 5)
+	opt := PairCountOptions{ Box: [3]float64{ 1, 1, 1 } }
+	randoms := NewTree(randomPoints(20000))
+
+	// Uniform points are uncorrelated.
+	xi := NewTree(randomPoints(5000)).CorrelationFunction(randoms, edges, opt)
+	for b := range xi {
+		if math.Abs(xi[b]) > 0.1 {
+			t.Errorf("Uniform points have xi = %.3f in bin %d.", xi[b], b)
+		}
+	}
+
+	// Clustered points are correlated on small scales.
+	x := clusteredPoints(5000)
+	for i := range x {
+		for k := 0; k < 3; k++ { x[i][k] = math.Mod(x[i][k] + 1, 1) }
+	}
+	xi = NewTree(x).CorrelationFunction(randoms, edges, opt)
+	if xi[0] < 10 || xi[0] < xi[len(xi) - 1] {
+		t.Errorf("Clustered points have xi = %.3g.", xi)
+	}
+
+	xi = LandySzalay([]int{ 1 }, []int{ 0 }, []int{ 0 }, 10, 10)
+	if !math.IsNaN(xi[0]) {
+		t.Errorf("Expected NaN for a bin without random pairs, got %g.", xi[0])
+	}
+}
@@ -0,0 +1,97 @@
+package gravitree
+
+import (
+	"fmt"
+	"math"
+)
+
+// PhaseDensityOptions customizes PhaseSpaceDensity. Zero values are replaced
+// by their defaults.
+type PhaseDensityOptions struct {
+	// K is the number of neighbors used to find each smoothing length,
+	// including the particle itself. Default: 64
+	K int
+	// Mass is the mass of each particle in input order. Default: every
+	// particle has a mass of 1.
+	Mass []float64
+	// XScale and VScale set the phase-space metric (see PhaseTree).
+	// Default: the position and velocity dispersions of all the points.
+	// Dispersions are sensitive to a few distant points, so these should be
+	// set by hand for systems with extended tails.
+	XScale, VScale float64
+}
+
+// PhaseSpaceDensity returns a kernel estimate of the 6D phase-space density,
+// f(x, v), of each point in input order. f has units of mass per d^3x d^3v.
+// It builds a PhaseTree from x and v and calls PhaseTree.Density.
+func PhaseSpaceDensity(
+	x, v [][3]float64, opt ...PhaseDensityOptions,
+) []float64 {
+	o := PhaseDensityOptions{ }
+	if len(opt) > 0 { o = opt[0] }
+	if o.XScale == 0 { o.XScale = dispersion(x) }
+	if o.VScale == 0 { o.VScale = dispersion(v) }
+	if o.XScale == 0 || o.VScale == 0 {
+		panic(fmt.Sprintf("Phase-space scales must be non-zero, got " +
+			"XScale = %g and VScale = %g.", o.XScale, o.VScale))
+	}
+	if o.K == 0 { o.K = 64 }
+
+	return NewPhaseTree(x, v, o.XScale, o.VScale).Density(o.K, o.Mass)
+}
+
+// Density returns a kernel estimate of the phase-space density of each point
+// in t, in input order. The smoothing length of each point is the scaled
+// distance to its k-th nearest neighbor and the neighbors are weighted with
+// a 6D Epanechnikov kernel, as in EnBiD (Sharma & Steinmetz 2006). mass gives
+// the mass of each point in input order, or can be nil for unit masses. The
+// points are split between workers.
+//
+// As with SPHDensity, each point's own mass is included, which biases
+// densities high when k is small.
+func (t *PhaseTree) Density(k int, mass []float64) []float64 {
+	if k <= 0 {
+		panic(fmt.Sprintf("k must be positive, got %d.", k))
+	} else if mass != nil && len(mass) != len(t.Points) {
+		panic(fmt.Sprintf("len(mass) = %d, but the tree has %d points.",
+			len(mass), len(t.Points)))
+	}
+
+	// Converts densities in scaled coordinates to physical ones.
+	xs3, vs3 := t.XScale*t.XScale*t.XScale, t.VScale*t.VScale*t.VScale
+	units := 1 / (xs3*vs3)
+
+	f := make([]float64, len(t.Points))
+	bufs := make([]*KNearestBuffer, nWorkers)
+	for w := range bufs { bufs[w] = &KNearestBuffer{ } }
+
+	runBatchQueries(len(t.Points), func(worker, j int) {
+		found, r2 := t.KNearest(t.Points[j], k, bufs[worker])
+		i := t.Index[j]
+		h2 := r2[len(r2) - 1]
+		if h2 == 0 {
+			f[i] = math.Inf(+1)
+			return
+		}
+
+		norm := epanechnikov6DNorm(h2)
+		for n := range found {
+			w := norm*(1 - r2[n]/h2)
+			if mass == nil {
+				f[i] += w
+			} else {
+				f[i] += w*mass[found[n]]
+			}
+		}
+		f[i] *= units
+	})
+
+	return f
+}
+
+// epanechnikov6DNorm returns the normalization of the 6D Epanechnikov kernel,
+// W(r) = norm*(1 - r^2/h^2), for the squared smoothing length h2. This is 4
+// divided by the volume of a 6-ball with radius h.
+func epanechnikov6DNorm(h2 float64) float64 {
+	return 24 / (math.Pi*math.Pi*math.Pi * h2*h2*h2)
+}
@@ -0,0 +1,88 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// plummerSphere samples n points from a Plummer sphere with G = M = a = 1
+// (Aarseth, Henon, & Wielen 1974). The sphere is truncated at r = 10 so that
+// a few distant points don't dominate its dispersion.
+func plummerSphere(n int) (x, v [][3]float64) {
+	x, v = make([][3]float64, n), make([][3]float64, n)
+	for i := range x {
+		r := math.Inf(+1)
+		for r > 10 {
+			r = 1 / math.Sqrt(math.Pow(rand.Float64(), -2.0/3) - 1)
+		}
+
+		// Velocities are drawn from g(q) = q^2 (1 - q^2)^(7/2) by rejection
+		// sampling.
+		q := 0.0
+		for {
+			q = rand.Float64()
+			if 0.1*rand.Float64() < q*q*math.Pow(1 - q*q, 3.5) { break }
+		}
+		vEsc := math.Sqrt2 * math.Pow(1 + r*r, -0.25)
+
+		x[i], v[i] = isotropicVector(r), isotropicVector(q*vEsc)
+	}
+	return x, v
+}
+
+// isotropicVector returns a vector with length r and a random direction.
+func isotropicVector(r float64) [3]float64 {
+	z := 2*rand.Float64() - 1
+	phi := 2*math.Pi*rand.Float64()
+	rxy := r*math.Sqrt(1 - z*z)
+	return [3]float64{ rxy*math.Cos(phi), rxy*math.Sin(phi), r*z }
+}
+
+// plummerDF returns the distribution function of a Plummer sphere with
+// G = M = a = 1.
+func plummerDF(x, v [3]float64) float64 {
+	r2 := x[0]*x[0] + x[1]*x[1] + x[2]*x[2]
+	v2 := v[0]*v[0] + v[1]*v[1] + v[2]*v[2]
+	E := v2/2 - 1/math.Sqrt(1 + r2)
+	if E >= 0 { return 0 }
+	return 24*math.Sqrt2/(7*math.Pi*math.Pi*math.Pi) * math.Pow(-E, 3.5)
+}
+
+func TestPhaseSpaceDensity(t *testing.T) {
+	rand.Seed(49)
+	n := 20000
+	x, v := plummerSphere(n)
+	mass := make([]float64, n)
+	for i := range mass { mass[i] = 1/float64(n) }
+
+	f := PhaseSpaceDensity(x, v, PhaseDensityOptions{ Mass: mass })
+	fFixed := PhaseSpaceDensity(x, v, PhaseDensityOptions{ K: 32,
+		Mass: mass, XScale: 1, VScale: 0.5 })
+
+	for _, est := range [][]float64{ f, fFixed } {
+		// Compare the estimates to the true DF in the well-sampled interior.
+		ratio := []float64{ }
+		for i := range x {
+			if calcR2(&x[i], &[3]float64{ }) > 2*2 { continue }
+			ratio = append(ratio, math.Log10(est[i]/plummerDF(x[i], v[i])))
+		}
+		sort.Float64s(ratio)
+		med := percentile(ratio, 0.5)
+		spread := percentile(ratio, 0.84) - percentile(ratio, 0.16)
+		if math.Abs(med) > 0.1 || spread > 0.4 {
+			t.Errorf("log10(f/f_true) has a median of %.3f and a 68%% " +
+				"spread of %.3f.", med, spread)
+		}
+	}
+
+	// Unit masses scale the density by n.
+	fUnit := PhaseSpaceDensity(x, v)
+	for i := range f {
+		if !almostEq(fUnit[i]/(f[i]*float64(n)), 1, 1e-10) {
+			t.Fatalf("%d) f = %g with unit masses, but %g with masses " +
+				"of 1/%d.", i, fUnit[i], f[i], n)
+		}
+	}
+}
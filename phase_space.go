@@ -0,0 +1,345 @@
+package gravitree
+
+import (
+	"fmt"
+)
+
+// PhaseTree is a k-d tree over six-dimensional phase-space points. Positions
+// are divided by XScale and velocities by VScale, so the distance between two
+// points is sqrt(|dx|^2/XScale^2 + |dv|^2/VScale^2). Queries take points in
+// these scaled coordinates, which can be made with Point.
+type PhaseTree struct {
+	Nodes []PhaseNode
+	Points [][6]float64 // Scaled points, reordered so nodes are contiguous.
+	Index []int // Index[j] is the original index of Points[j].
+	LeafSize int
+	XScale, VScale float64
+}
+
+// PhaseNode is a node in a PhaseTree. Leaves have Left == -1.
+type PhaseNode struct {
+	Span [2][6]float64
+	Left, Right int
+	Start, End int
+}
+
+// PhaseTreeOptions customizes NewPhaseTree. Zero values are replaced by
+// their defaults.
+type PhaseTreeOptions struct {
+	LeafSize int // Default: 16
+
+	// Buffers from a previous tree which can be reused (see Reuse).
+	PointsBuffer [][6]float64
+	IndexBuffer []int
+	NodeBuffer []PhaseNode
+}
+
+// Reuse returns a PhaseTreeOptions which reuses t's arrays. t can't be used
+// after the next tree is built with it.
+func (t *PhaseTree) Reuse() PhaseTreeOptions {
+	return PhaseTreeOptions{
+		LeafSize: t.LeafSize,
+		PointsBuffer: t.Points[:0],
+		IndexBuffer: t.Index[:0],
+		NodeBuffer: t.Nodes[:0],
+	}
+}
+
+// NewPhaseTree creates a PhaseTree from positions, x, and velocities, v,
+// which are scaled by xScale and vScale. Only the first PhaseTreeOptions
+// argument will be used.
+func NewPhaseTree(
+	x, v [][3]float64, xScale, vScale float64, opt ...PhaseTreeOptions,
+) *PhaseTree {
+	if len(x) != len(v) {
+		panic(fmt.Sprintf("len(x) = %d, but len(v) = %d", len(x), len(v)))
+	} else if xScale <= 0 || vScale <= 0 {
+		panic(fmt.Sprintf("Phase-space scales must be positive, got " +
+			"xScale = %g and vScale = %g.", xScale, vScale))
+	}
+
+	o := PhaseTreeOptions{ }
+	if len(opt) > 0 { o = opt[0] }
+	if o.LeafSize == 0 { o.LeafSize = 16 }
+
+	n := len(x)
+	t := &PhaseTree{ LeafSize: o.LeafSize, XScale: xScale, VScale: vScale }
+	t.Points = append(o.PointsBuffer[:0], make([][6]float64, n)...)
+	t.Index = append(o.IndexBuffer[:0], make([]int, n)...)
+	t.Nodes = o.NodeBuffer[:0]
+
+	for i := range x {
+		t.Points[i], t.Index[i] = t.Point(x[i], v[i]), i
+	}
+
+	if n > 0 { t.addNode(0, n) }
+	return t
+}
+
+// Point returns the scaled phase-space point of a position and velocity.
+func (t *PhaseTree) Point(x, v [3]float64) [6]float64 {
+	return [6]float64{ x[0]/t.XScale, x[1]/t.XScale, x[2]/t.XScale,
+		v[0]/t.VScale, v[1]/t.VScale, v[2]/t.VScale }
+}
+
+// addNode adds a node containing the points in [start, end) and splits it
+// at the midpoint of its widest dimension.
+func (t *PhaseTree) addNode(start, end int) {
+	span := phaseSpan(t.Points[start: end])
+	i := len(t.Nodes)
+	t.Nodes = append(t.Nodes, PhaseNode{ span, -1, -1, start, end })
+
+	if end - start <= t.LeafSize { return }
+
+	dim := 0
+	for k := 1; k < 6; k++ {
+		if span[1][k] - span[0][k] > span[1][dim] - span[0][dim] { dim = k }
+	}
+	pivot := span[0][dim] + (span[1][dim] - span[0][dim])/2
+	mid := partitionPhase(t.Points[start: end], t.Index[start: end],
+		dim, pivot)
+	// Points at the same position can't be split.
+	if mid == 0 || mid == end - start { return }
+
+	t.Nodes[i].Left = len(t.Nodes)
+	t.addNode(start, start + mid)
+	t.Nodes[i].Right = len(t.Nodes)
+	t.addNode(start + mid, end)
+}
+
+// phaseSpan returns the span of a non-empty collection of points.
+func phaseSpan(x [][6]float64) [2][6]float64 {
+	span := [2][6]float64{ x[0], x[0] }
+	for i := 1; i < len(x); i++ {
+		for k := 0; k < 6; k++ {
+			if x[i][k] < span[0][k] {
+				span[0][k] = x[i][k]
+			} else if x[i][k] > span[1][k] {
+				span[1][k] = x[i][k]
+			}
+		}
+	}
+	return span
+}
+
+// partitionPhase reorders x and idx so that the points with x[dim] <= pivot
+// come first and returns the number of them.
+func partitionPhase(x [][6]float64, idx []int, dim int, pivot float64) int {
+	l, r := 0, len(x) - 1
+	for l <= r {
+		if x[l][dim] <= pivot {
+			l++
+			continue
+		}
+		x[l], x[r] = x[r], x[l]
+		idx[l], idx[r] = idx[r], idx[l]
+		r--
+	}
+	return l
+}
+
+// SearchSphere returns the original indices of the points within r of the
+// scaled point x. An optional output buffer can be passed to reduce
+// allocations.
+func (t *PhaseTree) SearchSphere(x [6]float64, r float64, buf ...[]int) []int {
+	var out []int
+	if len(buf) > 0 {
+		out = buf[0][:0]
+	} else {
+		out = []int{ }
+	}
+	if len(t.Nodes) == 0 { return out }
+	return t.walkSearchSphere(0, &x, r*r, out)
+}
+
+func (t *PhaseTree) walkSearchSphere(
+	i int, x *[6]float64, r2 float64, buf []int,
+) []int {
+	node := &t.Nodes[i]
+	if phaseBoxDist2(x, &node.Span) >= r2 {
+		return buf
+	} else if phaseBoxMaxDist2(x, &node.Span) < r2 {
+		return append(buf, t.Index[node.Start: node.End]...)
+	} else if node.Left == -1 {
+		for j := node.Start; j < node.End; j++ {
+			if phaseR2(x, &t.Points[j]) < r2 { buf = append(buf, t.Index[j]) }
+		}
+		return buf
+	}
+	buf = t.walkSearchSphere(node.Left, x, r2, buf)
+	return t.walkSearchSphere(node.Right, x, r2, buf)
+}
+
+// KNearest returns the original indices of the k points nearest to the
+// scaled point x and their squared scaled distances, sorted from nearest to
+// farthest. It works the same way as Tree.KNearest.
+func (t *PhaseTree) KNearest(
+	x [6]float64, k int, buf ...*KNearestBuffer,
+) ([]int, []float64) {
+	var h *KNearestBuffer
+	if len(buf) > 0 {
+		h = buf[0]
+	} else {
+		h = &KNearestBuffer{ }
+	}
+	h.idx, h.r2 = h.idx[:0], h.r2[:0]
+	if k <= 0 || len(t.Nodes) == 0 { return h.idx, h.r2 }
+
+	h.walkPhaseKNearest(t, 0, &x, k)
+
+	for n := len(h.r2) - 1; n > 0; n-- {
+		h.swap(0, n)
+		h.siftDown(0, n)
+	}
+	for i := range h.idx { h.idx[i] = t.Index[h.idx[i]] }
+
+	return h.idx, h.r2
+}
+
+func (h *KNearestBuffer) walkPhaseKNearest(
+	t *PhaseTree, i int, x *[6]float64, k int,
+) {
+	node := &t.Nodes[i]
+	if len(h.r2) == k && phaseBoxDist2(x, &node.Span) >= h.r2[0] { return }
+
+	if node.Left == -1 {
+		for j := node.Start; j < node.End; j++ {
+			h.push(j, phaseR2(x, &t.Points[j]), k)
+		}
+		return
+	}
+
+	left, right := node.Left, node.Right
+	if phaseBoxDist2(x, &t.Nodes[right].Span) <
+		phaseBoxDist2(x, &t.Nodes[left].Span) {
+		left, right = right, left
+	}
+	h.walkPhaseKNearest(t, left, x, k)
+	h.walkPhaseKNearest(t, right, x, k)
+}
+
+// FriendsOfFriends links every pair of points separated by less than the
+// scaled linking length, b, and returns the connected groups with at least
+// minMembers points. It works the same way as Tree.FriendsOfFriends.
+func (t *PhaseTree) FriendsOfFriends(b float64, minMembers int) *FoFGroups {
+	if b < 0 {
+		panic(fmt.Sprintf("Linking length must be non-negative, got %g.", b))
+	}
+
+	parent := make([]int64, len(t.Points))
+	for i := range parent { parent[i] = int64(i) }
+
+	b2 := b*b
+	WorkerQueue(nWorkers, len(t.Nodes), func(worker, i int) {
+		if t.Nodes[i].Left == -1 { t.linkLeaf(0, i, b2, parent) }
+	})
+
+	root := make([]int, len(t.Points))
+	WorkerQueue(nWorkers, len(t.Nodes), func(worker, i int) {
+		if t.Nodes[i].Left != -1 { return }
+		for j := t.Nodes[i].Start; j < t.Nodes[i].End; j++ {
+			root[j] = int(unionFind(parent, int64(j)))
+		}
+	})
+
+	return newFoFGroups(root, t.Index, minMembers)
+}
+
+// linkLeaf is the same as the Tree function linkLeaf, but for PhaseTrees.
+func (t *PhaseTree) linkLeaf(i1, i2 int, b2 float64, parent []int64) {
+	node1, node2 := &t.Nodes[i1], &t.Nodes[i2]
+	if node1.End <= node2.Start ||
+		phaseBoxBoxDist2(&node1.Span, &node2.Span) >= b2 { return }
+
+	if i1 != i2 && node1.Left == -1 && phaseBoxBoxMaxDist2(&node1.Span,
+		&node2.Span) < b2 {
+		for j := node1.Start; j < node1.End; j++ {
+			union(parent, int64(j), int64(node2.Start))
+		}
+		for j := node2.Start; j < node2.End; j++ {
+			union(parent, int64(j), int64(node1.Start))
+		}
+		return
+	}
+
+	if node1.Left != -1 {
+		t.linkLeaf(node1.Left, i2, b2, parent)
+		t.linkLeaf(node1.Right, i2, b2, parent)
+		return
+	}
+
+	for j2 := node2.Start; j2 < node2.End; j2++ {
+		start := node1.Start
+		if i1 == i2 { start = j2 + 1 }
+		for j1 := start; j1 < node1.End; j1++ {
+			if phaseR2(&t.Points[j1], &t.Points[j2]) < b2 {
+				union(parent, int64(j1), int64(j2))
+			}
+		}
+	}
+}
+
+func phaseR2(x1, x2 *[6]float64) float64 {
+	r2 := 0.0
+	for k := 0; k < 6; k++ {
+		dx := x1[k] - x2[k]
+		r2 += dx*dx
+	}
+	return r2
+}
+
+// phaseBoxDist2 returns the squared minimum distance between x and the box
+// span.
+func phaseBoxDist2(x *[6]float64, span *[2][6]float64) float64 {
+	d2 := 0.0
+	for k := 0; k < 6; k++ {
+		if x[k] < span[0][k] {
+			dx := span[0][k] - x[k]
+			d2 += dx*dx
+		} else if x[k] > span[1][k] {
+			dx := x[k] - span[1][k]
+			d2 += dx*dx
+		}
+	}
+	return d2
+}
+
+// phaseBoxMaxDist2 returns the squared maximum distance between x and any
+// point in the box span.
+func phaseBoxMaxDist2(x *[6]float64, span *[2][6]float64) float64 {
+	d2 := 0.0
+	for k := 0; k < 6; k++ {
+		dx := x[k] - span[0][k]
+		if dx2 := span[1][k] - x[k]; dx2 > dx { dx = dx2 }
+		d2 += dx*dx
+	}
+	return d2
+}
+
+// phaseBoxBoxDist2 returns the squared minimum distance between any point in
+// box a and any point in box b.
+func phaseBoxBoxDist2(a, b *[2][6]float64) float64 {
+	d2 := 0.0
+	for k := 0; k < 6; k++ {
+		if a[1][k] < b[0][k] {
+			dx := b[0][k] - a[1][k]
+			d2 += dx*dx
+		} else if b[1][k] < a[0][k] {
+			dx := a[0][k] - b[1][k]
+			d2 += dx*dx
+		}
+	}
+	return d2
+}
+
+// phaseBoxBoxMaxDist2 returns the squared maximum distance between any point
+// in box a and any point in box b.
+func phaseBoxBoxMaxDist2(a, b *[2][6]float64) float64 {
+	d2 := 0.0
+	for k := 0; k < 6; k++ {
+		dx := b[1][k] - a[0][k]
+		if dx2 := a[1][k] - b[0][k]; dx2 > dx { dx = dx2 }
+		d2 += dx*dx
+	}
+	return d2
+}
@@ -0,0 +1,100 @@
+package gravitree
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// randomPhasePoints returns clustered positions with velocities on a very
+// different scale.
+func randomPhasePoints(n int) (x, v [][3]float64) {
+	x = clusteredPoints(n)
+	v = make([][3]float64, len(x))
+	for i := range v {
+		for k := 0; k < 3; k++ { v[i][k] = 100*rand.NormFloat64() }
+	}
+	return x, v
+}
+
+func TestPhaseTreeSearch(t *testing.T) {
+	rand.Seed(46)
+	x, v := randomPhasePoints(3000)
+	for _, leafSize := range []int{ 1, 16 } {
+		tree := NewPhaseTree(x, v, 0.1, 50,
+			PhaseTreeOptions{ LeafSize: leafSize })
+		points := make([][6]float64, len(x))
+		for i := range x { points[i] = tree.Point(x[i], v[i]) }
+
+		for i := 0; i < 50; i++ {
+			q := points[rand.Intn(len(points))]
+			q[0] += 0.1*rand.NormFloat64()
+			r := rand.Float64()
+
+			found := tree.SearchSphere(q, r)
+			n := 0
+			for j := range points {
+				if phaseR2(&q, &points[j]) < r*r { n++ }
+			}
+			if len(found) != n {
+				t.Errorf("%d) expected %d points in sphere, found %d",
+					i, n, len(found))
+			}
+			for _, j := range found {
+				if phaseR2(&q, &points[j]) >= r*r {
+					t.Errorf("%d) point %d is outside the sphere", i, j)
+				}
+			}
+
+			k := 1 + rand.Intn(20)
+			idx, r2 := tree.KNearest(q, k)
+			exp := make([]float64, len(points))
+			for j := range points { exp[j] = phaseR2(&q, &points[j]) }
+			sort.Float64s(exp)
+			if len(idx) != k {
+				t.Fatalf("%d) expected %d neighbors, got %d", i, k, len(idx))
+			}
+			for j := range idx {
+				if r2[j] != exp[j] ||
+					phaseR2(&q, &points[idx[j]]) != r2[j] {
+					t.Errorf("%d) neighbor %d of %d has r2 = %g, expected %g",
+						i, j, k, r2[j], exp[j])
+				}
+			}
+		}
+	}
+}
+
+func TestPhaseTreeFriendsOfFriends(t *testing.T) {
+	rand.Seed(47)
+	x, v := randomPhasePoints(3000)
+	tree := NewPhaseTree(x, v, 0.05, 30)
+	points := make([][6]float64, len(x))
+	for i := range x { points[i] = tree.Point(x[i], v[i]) }
+
+	for _, b := range []float64{ 0, 0.2, 0.5, 1 } {
+		// Brute force search.
+		parent := make([]int64, len(x))
+		for i := range parent { parent[i] = int64(i) }
+		for i := range points {
+			for j := i + 1; j < len(points); j++ {
+				if phaseR2(&points[i], &points[j]) < b*b {
+					union(parent, int64(i), int64(j))
+				}
+			}
+		}
+		root := make([]int, len(x))
+		index := make([]int, len(x))
+		for i := range root {
+			root[i], index[i] = int(unionFind(parent, int64(i))), i
+		}
+		exp := newFoFGroups(root, index, 5)
+
+		groups := tree.FriendsOfFriends(b, 5)
+		if !intsEqual(groups.Sizes, exp.Sizes) ||
+			!intsEqual(groups.ID, exp.ID) {
+			t.Errorf("b = %g: found %d groups, expected %d.", b,
+				len(groups.Sizes), len(exp.Sizes))
+		}
+	}
+}
@@ -35,7 +35,7 @@ func (phi Potential) TwoSidedLeaf(t *Tree, i int) {
 func (phi Potential) Approximate(t1, t2 *Tree, i1, i2 int) {
 	// writes the approximated potential for nodes in
 	// t2 from nodes in t1
-	switch t2.Order {
+	switch order := t1.approximationOrder(t2, i1, i2); order {
 	case Monopole:
 		// Loops over the t2 nodes, calculating the
 		// contributions from the t1 nodes.
@@ -56,10 +56,35 @@ func (phi Potential) Approximate(t1, t2 *Tree, i1, i2 int) {
 			phi[idx_i2] += pointPotential(dx2, t1.eps2) * mass_i1
 		}
 	case Quadrupole:
-		// TODO: Implement (Plummer) quadrupole appoximation of potential
-		panic("NYI")
+		// Plummer-softened quadrupole approximation. With d = x - x_cm,
+		// phi = -(M f + (tr(Q) h1 + d.Q.d h2)/2), where f = 1/sqrt(r^2 +
+		// eps^2) and h_n are the derivatives of f with respect to r^2/2.
+		node_i2, node_i1 := &t2.Nodes[i2], &t1.Nodes[i1]
+		x_i1 := &node_i1.Center
+		mass_i1 := float64(node_i1.End - node_i1.Start)
+		q := &t1.Q[i1]
+		trQ := t1.P[i1][0] + t1.P[i1][1] + t1.P[i1][2]
+
+		for i2 := node_i2.Start; i2 < node_i2.End; i2++ {
+			x_i2, idx_i2 := &t2.Points[i2], t2.Index[i2]
+
+			d := [3]float64{ x_i2[0] - x_i1[0], x_i2[1] - x_i1[1],
+				x_i2[2] - x_i1[2] }
+			r2 := d[0]*d[0] + d[1]*d[1] + d[2]*d[2] + t1.eps2
+			f := 1 / math.Sqrt(r2)
+			h1 := -f / r2
+			h2 := -3 * h1 / r2
+
+			phi[idx_i2] -= mass_i1*f + (trQ*h1 + quadForm(q, &d)*h2)/2
+		}
+	case Octupole, Hexadecapole:
+		node_i2 := &t2.Nodes[i2]
+		k := newMultipoleKernel(t1, i1, order)
+		for i2 := node_i2.Start; i2 < node_i2.End; i2++ {
+			phi[t2.Index[i2]] += k.potential(&t2.Points[i2])
+		}
 	default:
-		panic(fmt.Sprintf("Unrecognized approximation order code, %d", t2.Order))
+		panic(fmt.Sprintf("Unrecognized approximation order code, %d", order))
 	}
 }
 
@@ -120,6 +145,17 @@ func dist2(x1, x2 [3]float64) float64 {
 	return dx2
 }
 
+// quadForm returns d.Q.d.
+func quadForm(q *[3][3]float64, d *[3]float64) float64 {
+	sum := 0.0
+	for k1 := 0; k1 < 3; k1++ {
+		for k2 := 0; k2 < 3; k2++ {
+			sum += d[k1]*q[k1][k2]*d[k2]
+		}
+	}
+	return sum
+}
+
 func pointPotential(r2, eps2 float64) float64 {
 	return -1.0 / math.Sqrt(r2+eps2)
 }
@@ -139,7 +139,10 @@ BARNES_HUT_CRITERIA = 2
 #############################
 
 MONOPOLE_ORDER = 0
-QUADRUPOLE_ORDER = 1 # TODO: implement quadrupole order
+QUADRUPOLE_ORDER = 1
+OCTUPOLE_ORDER = 2
+HEXADECAPOLE_ORDER = 3
+ADAPTIVE_ORDER = -1
 
 class TreeParameters(object):
     def __init__(self, leaf_size=16, criteria=PKDGRAV_CRITERIA,
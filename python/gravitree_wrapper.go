@@ -4,15 +4,31 @@ import (
 	"github.com/phil-mansfield/gravitree"
 
 	"C"
+	"fmt"
 	"unsafe"
 )
 
+// criteria maps the criteria codes used by gravitree.py to OpeningCriteria.
+// The code is the index into this slice, so the constants in gravitree.py
+// must match its order: PKDGRAV_CRITERIA = 0 (PKDGRAV3),
+// SALMON_WARREN_HUT_CRITERIA = 1 (SalmonWarren), and BARNES_HUT_CRITERIA = 2
+// (BarnesHut).
+var criteria = []gravitree.OpeningCriteria{
+	gravitree.PKDGRAV3, gravitree.SalmonWarren, gravitree.BarnesHut,
+}
+
 func paramToOptions(param *C.double) gravitree.TreeOptions {
 	p := unsafe.Slice((*float64)(unsafe.Pointer(param)), 4)
+	code := int(p[1])
+	if code < 0 || code >= len(criteria) {
+		panic(fmt.Sprintf("Criteria code %d is not in [0, %d): the valid " +
+			"codes are 0 (PKDGRAV3), 1 (SalmonWarren), and 2 (BarnesHut).",
+			code, len(criteria)))
+	}
 	
 	return gravitree.TreeOptions{
 		LeafSize: int(p[0]),
-		Criteria: gravitree.OpeningCriteria(p[1]),
+		Criteria: criteria[code],
 		Theta: p[2],
 		Order: gravitree.ApproximationOrder(p[3]),
 	}
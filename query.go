@@ -5,6 +5,14 @@ import (
 )
 
 func (t *Tree) SearchSphere(x [3]float64, r float64, buf... []int) []int {
+	return searchSphere(t.spatialIndex(), x, r, buf...)
+}
+
+// searchSphere is the same as SearchSphere, except that it walks any
+// SpatialIndex.
+func searchSphere(
+	idx SpatialIndex, x [3]float64, r float64, buf... []int,
+) []int {
 	var out []int
 	if len(buf) > 0 {
 		out = buf[0]
@@ -13,28 +21,29 @@ func (t *Tree) SearchSphere(x [3]float64, r float64, buf... []int) []int {
 	}
 	out = out[:0]
 
-	return t.walkTreeSearchSphere(0, x, r, out)
+	t := idx.Base()
+	if len(t.Nodes) == 0 { return out }
+	return walkTreeSearchSphere(idx, t, 0, x, r, out)
 }
 
-func (t *Tree) walkTreeSearchSphere(
-	i int, x [3]float64, r float64, buf []int,
+func walkTreeSearchSphere(
+	idx SpatialIndex, t *Tree, i int, x [3]float64, r float64, buf []int,
 ) []int {
 	n := &t.Nodes[i]
+	r2 := r*r
 	// the first three conditionals are base cases, the last one is the
 	// recursive case.
 
-	// This square root is painful, but I don't know how to avoid it, tbh
-	if dr := math.Sqrt(calcR2(&x, &n.Center)); dr - n.RMax > r {
+	if boxDist2(&x, &n.Span) >= r2 {
 		// Node and sphere are disjoint
 		return buf
-	} else if dr + n.RMax < r {
+	} else if boxMaxDist2(&x, &n.Span) < r2 {
 		// Node completely contained within sphere: add everything
 		for i := n.Start; i < n.End; i++ {
 			buf = append(buf, t.Index[i])
 		}
 		return buf
 	} else if t.Nodes[i].Left == -1 {
-		r2 := r*r
 		// Leaf node, do a brue force search
 		for i := n.Start; i < n.End; i++ {
 			dr2 := calcR2(&x, &t.Points[i])
@@ -44,12 +53,326 @@ func (t *Tree) walkTreeSearchSphere(
 		}
 		return buf
 	} else {
-		buf = t.walkTreeSearchSphere(n.Left, x, r, buf)
-		buf = t.walkTreeSearchSphere(n.Right, x, r, buf)
+		for c, nc := 0, idx.NumChildren(i); c < nc; c++ {
+			buf = walkTreeSearchSphere(idx, t, idx.Child(i, c), x, r, buf)
+		}
+		return buf
+	}
+}
+
+// SearchBox returns the original indices of the points in the axis-aligned
+// box which contains points with span[0][k] <= x[k] < span[1][k]. Boxes are
+// half-open so that adjacent boxes don't share points. An optional output
+// buffer can be passed to reduce allocations.
+func (t *Tree) SearchBox(span [2][3]float64, buf... []int) []int {
+	return searchBox(t.spatialIndex(), span, buf...)
+}
+
+// searchBox is the same as SearchBox, except that it walks any SpatialIndex.
+func searchBox(idx SpatialIndex, span [2][3]float64, buf... []int) []int {
+	var out []int
+	if len(buf) > 0 {
+		out = buf[0]
+	} else {
+		out = []int{ }
+	}
+	out = out[:0]
+
+	t := idx.Base()
+	if len(t.Nodes) == 0 { return out }
+	return walkTreeSearchBox(idx, t, 0, &span, out)
+}
+
+func walkTreeSearchBox(
+	idx SpatialIndex, t *Tree, i int, span *[2][3]float64, buf []int,
+) []int {
+	n := &t.Nodes[i]
+
+	if !boxOverlaps(&n.Span, span) {
+		// Node and box are disjoint
+		return buf
+	} else if boxContains(span, &n.Span) {
+		// Node completely contained within box: add everything
+		for i := n.Start; i < n.End; i++ {
+			buf = append(buf, t.Index[i])
+		}
+		return buf
+	} else if t.Nodes[i].Left == -1 {
+		// Leaf node, do a brute force search
+		for i := n.Start; i < n.End; i++ {
+			if inBox(&t.Points[i], span) {
+				buf = append(buf, t.Index[i])
+			}
+		}
+		return buf
+	} else {
+		for c, nc := 0, idx.NumChildren(i); c < nc; c++ {
+			buf = walkTreeSearchBox(idx, t, idx.Child(i, c), span, buf)
+		}
+		return buf
+	}
+}
+
+// inBox returns true if x is in the half-open box span.
+func inBox(x *[3]float64, span *[2][3]float64) bool {
+	for k := 0; k < 3; k++ {
+		if x[k] < span[0][k] || x[k] >= span[1][k] { return false }
+	}
+	return true
+}
+
+// boxOverlaps returns true if the closed box, a, may contain points in the
+// half-open box, b.
+func boxOverlaps(a, b *[2][3]float64) bool {
+	for k := 0; k < 3; k++ {
+		if a[1][k] < b[0][k] || a[0][k] >= b[1][k] { return false }
+	}
+	return true
+}
+
+// boxContains returns true if every point in the closed box, b, is inside
+// the half-open box, a.
+func boxContains(a, b *[2][3]float64) bool {
+	for k := 0; k < 3; k++ {
+		if b[0][k] < a[0][k] || b[1][k] >= a[1][k] { return false }
+	}
+	return true
+}
+
+// SearchCylinder returns the original indices of the points within a
+// distance r of the line segment from x0 to x1. This includes the points
+// whose projections onto the line lie between x0 and x1, so the cylinder has
+// flat caps. If x0 == x1, the cylinder has no volume and no points are
+// returned. An optional output buffer can be passed to reduce allocations.
+func (t *Tree) SearchCylinder(
+	x0, x1 [3]float64, r float64, buf... []int,
+) []int {
+	return searchCylinder(t.spatialIndex(), x0, x1, r, buf...)
+}
+
+// searchCylinder is the same as SearchCylinder, except that it walks any
+// SpatialIndex.
+func searchCylinder(
+	idx SpatialIndex, x0, x1 [3]float64, r float64, buf... []int,
+) []int {
+	var out []int
+	if len(buf) > 0 {
+		out = buf[0]
+	} else {
+		out = []int{ }
+	}
+	out = out[:0]
+
+	t := idx.Base()
+	if len(t.Nodes) == 0 || x0 == x1 { return out }
+	c := newCylinder(x0, x1, r)
+	return walkTreeSearchCylinder(idx, t, 0, c, out)
+}
+
+// cylinder is a finite cylinder with flat caps.
+type cylinder struct {
+	x0, dir [3]float64 // The start of the axis and its unit direction.
+	length, r2 float64
+	span [2][3]float64 // A bounding box of the cylinder.
+}
+
+func newCylinder(x0, x1 [3]float64, r float64) *cylinder {
+	c := &cylinder{ x0: x0, r2: r*r }
+	c.length = math.Sqrt(calcR2(&x0, &x1))
+	for k := 0; k < 3; k++ {
+		c.dir[k] = (x1[k] - x0[k]) / c.length
+		c.span[0][k] = math.Min(x0[k], x1[k]) - r
+		c.span[1][k] = math.Max(x0[k], x1[k]) + r
+	}
+	return c
+}
+
+// contains returns true if x is inside the cylinder.
+func (c *cylinder) contains(x *[3]float64) bool {
+	dx := [3]float64{ x[0] - c.x0[0], x[1] - c.x0[1], x[2] - c.x0[2] }
+	s := dx[0]*c.dir[0] + dx[1]*c.dir[1] + dx[2]*c.dir[2]
+	if s < 0 || s > c.length { return false }
+	return dx[0]*dx[0] + dx[1]*dx[1] + dx[2]*dx[2] - s*s < c.r2
+}
+
+// disjoint returns true if node n can't contain any points in the cylinder.
+// This uses the cylinder's bounding box and the distance from the node's
+// bounding sphere to the axis.
+func (c *cylinder) disjoint(n *Node) bool {
+	if boxBoxDist2(&n.Span, &c.span) > 0 { return true }
+
+	dx := [3]float64{ n.Center[0] - c.x0[0], n.Center[1] - c.x0[1],
+		n.Center[2] - c.x0[2] }
+	s := dx[0]*c.dir[0] + dx[1]*c.dir[1] + dx[2]*c.dir[2]
+	s = math.Max(0, math.Min(c.length, s))
+	d2 := 0.0
+	for k := 0; k < 3; k++ {
+		d := dx[k] - s*c.dir[k]
+		d2 += d*d
+	}
+	r := math.Sqrt(c.r2) + n.RMax
+	return d2 >= r*r
+}
+
+// containsBox returns true if every point in the box is inside the
+// cylinder. Cylinders are convex, so it's enough to check the corners.
+func (c *cylinder) containsBox(span *[2][3]float64) bool {
+	for corner := 0; corner < 8; corner++ {
+		x := [3]float64{ }
+		for k := 0; k < 3; k++ { x[k] = span[(corner >> k) & 1][k] }
+		if !c.contains(&x) { return false }
+	}
+	return true
+}
+
+func walkTreeSearchCylinder(
+	idx SpatialIndex, t *Tree, i int, c *cylinder, buf []int,
+) []int {
+	n := &t.Nodes[i]
+
+	if c.disjoint(n) {
+		// Node and cylinder are disjoint
+		return buf
+	} else if c.containsBox(&n.Span) {
+		// Node completely contained within cylinder: add everything
+		for i := n.Start; i < n.End; i++ {
+			buf = append(buf, t.Index[i])
+		}
+		return buf
+	} else if t.Nodes[i].Left == -1 {
+		// Leaf node, do a brute force search
+		for i := n.Start; i < n.End; i++ {
+			if c.contains(&t.Points[i]) {
+				buf = append(buf, t.Index[i])
+			}
+		}
+		return buf
+	} else {
+		for ci, nc := 0, idx.NumChildren(i); ci < nc; ci++ {
+			buf = walkTreeSearchCylinder(idx, t, idx.Child(i, ci), c, buf)
+		}
 		return buf
 	}
 }
 
+// KNearestBuffer holds the bounded priority queue used by KNearest. Reusing
+// one between queries avoids allocations. The slices returned by a query
+// that used a buffer are overwritten by the buffer's next query.
+type KNearestBuffer struct {
+	idx []int
+	r2 []float64
+}
+
+// KNearest returns the original indices of the k points in t nearest to x and
+// their squared distances from x, sorted from nearest to farthest. If t has
+// fewer than k points, all of them are returned. An optional buffer can be
+// passed to reduce allocations.
+func (t *Tree) KNearest(
+	x [3]float64, k int, buf ...*KNearestBuffer,
+) ([]int, []float64) {
+	return kNearest(t.spatialIndex(), x, k, buf...)
+}
+
+// kNearest is the same as KNearest, except that it walks any SpatialIndex.
+func kNearest(
+	idx SpatialIndex, x [3]float64, k int, buf ...*KNearestBuffer,
+) ([]int, []float64) {
+	var h *KNearestBuffer
+	if len(buf) > 0 {
+		h = buf[0]
+	} else {
+		h = &KNearestBuffer{ }
+	}
+	h.idx, h.r2 = h.idx[:0], h.r2[:0]
+
+	t := idx.Base()
+	if k <= 0 || len(t.Nodes) == 0 { return h.idx, h.r2 }
+
+	h.walkKNearest(idx, t, 0, &x, k)
+
+	// Heap sort the queue so that the nearest points come first.
+	for n := len(h.r2) - 1; n > 0; n-- {
+		h.swap(0, n)
+		h.siftDown(0, n)
+	}
+	for i := range h.idx { h.idx[i] = t.Index[h.idx[i]] }
+
+	return h.idx, h.r2
+}
+
+// walkKNearest adds the points in node i to the queue, skipping nodes which
+// can't contain any points closer than the farthest point in a full queue.
+func (h *KNearestBuffer) walkKNearest(
+	idx SpatialIndex, t *Tree, i int, x *[3]float64, k int,
+) {
+	node := &t.Nodes[i]
+	if len(h.r2) == k && nodeMinDist2(node, x) >= h.r2[0] { return }
+
+	nc := idx.NumChildren(i)
+	if nc == 0 {
+		for j := node.Start; j < node.End; j++ {
+			h.push(j, calcR2(x, &t.Points[j]), k)
+		}
+		return
+	}
+
+	// Visit the closest children first so that the queue shrinks faster.
+	if nc == 2 && nodeMinDist2(&t.Nodes[idx.Child(i, 1)], x) <
+		nodeMinDist2(&t.Nodes[idx.Child(i, 0)], x) {
+		h.walkKNearest(idx, t, idx.Child(i, 1), x, k)
+		h.walkKNearest(idx, t, idx.Child(i, 0), x, k)
+		return
+	}
+	for c := 0; c < nc; c++ {
+		h.walkKNearest(idx, t, idx.Child(i, c), x, k)
+	}
+}
+
+// nodeMinDist2 returns a lower bound on the squared distance between x and
+// the points in a node. This is the larger of the bounds given by the node's
+// RMax and by its bounding box.
+func nodeMinDist2(node *Node, x *[3]float64) float64 {
+	box2 := boxDist2(x, &node.Span)
+	r := math.Sqrt(calcR2(&node.Center, x)) - node.RMax
+	if r <= 0 || r*r < box2 { return box2 }
+	return r*r
+}
+
+// push adds point j to the max-heap of the k nearest points if there's room
+// or if it's closer than the current farthest point.
+func (h *KNearestBuffer) push(j int, r2 float64, k int) {
+	if len(h.r2) < k {
+		h.idx, h.r2 = append(h.idx, j), append(h.r2, r2)
+		// Sift up.
+		for c := len(h.r2) - 1; c > 0; {
+			p := (c - 1)/2
+			if h.r2[p] >= h.r2[c] { break }
+			h.swap(p, c)
+			c = p
+		}
+	} else if r2 < h.r2[0] {
+		h.idx[0], h.r2[0] = j, r2
+		h.siftDown(0, len(h.r2))
+	}
+}
+
+// siftDown restores the max-heap property of the first n elements below p.
+func (h *KNearestBuffer) siftDown(p, n int) {
+	for {
+		c := 2*p + 1
+		if c >= n { return }
+		if c + 1 < n && h.r2[c + 1] > h.r2[c] { c++ }
+		if h.r2[p] >= h.r2[c] { return }
+		h.swap(p, c)
+		p = c
+	}
+}
+
+func (h *KNearestBuffer) swap(i, j int) {
+	h.idx[i], h.idx[j] = h.idx[j], h.idx[i]
+	h.r2[i], h.r2[j] = h.r2[j], h.r2[i]
+}
+
 func calcR2(x1, x2 *[3]float64) float64 {
 	dx := x1[0] - x2[0]
 	dy := x1[1] - x2[1]
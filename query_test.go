@@ -4,6 +4,7 @@ import (
 	"testing"
 	"math/rand"
 	"math"
+	"sort"
 )
 
 func TestSearchSphere(t *testing.T) {
@@ -42,4 +43,163 @@ func TestSearchSphere(t *testing.T) {
 		t.Errorf("Manual search and Tree.SearchSphere only agreed on %d " + 
 			"points, not %d", nOk, n)
 	}
-}
\ No newline at end of file
+}
+
+func TestKNearest(t *testing.T) {
+	rand.Seed(20)
+	x := normalPoints(2000)
+	// Duplicate points have ties in distance.
+	x = append(x, x[:50]...)
+
+	tree, ot := NewTree(x), NewOctree(x, TreeOptions{ LeafSize: 4 })
+	buf := &KNearestBuffer{ }
+
+	for trial := 0; trial < 50; trial++ {
+		pt := [3]float64{ rand.NormFloat64(), rand.NormFloat64(),
+			rand.NormFloat64() }
+		if trial % 5 == 0 { pt = x[trial] }
+
+		r2 := make([]float64, len(x))
+		for i := range x { r2[i] = calcR2(&pt, &x[i]) }
+		sorted := append([]float64{ }, r2...)
+		sort.Float64s(sorted)
+
+		for _, k := range []int{ 0, 1, 7, 64, len(x) + 10 } {
+			var idx []int
+			var dist2 []float64
+			if trial % 2 == 0 {
+				idx, dist2 = tree.KNearest(pt, k, buf)
+			} else {
+				idx, dist2 = ot.KNearest(pt, k)
+			}
+
+			nExp := k
+			if nExp > len(x) { nExp = len(x) }
+			if len(idx) != nExp || len(dist2) != nExp {
+				t.Fatalf("k = %d: expected %d neighbors, got %d.",
+					k, nExp, len(idx))
+			}
+
+			seen := map[int]bool{ }
+			for j := range idx {
+				if seen[idx[j]] {
+					t.Fatalf("k = %d: index %d returned twice.", k, idx[j])
+				}
+				seen[idx[j]] = true
+				if dist2[j] != sorted[j] || r2[idx[j]] != dist2[j] {
+					t.Fatalf("k = %d: neighbor %d is %d with r2 = %g, " +
+						"expected r2 = %g.", k, j, idx[j], dist2[j],
+						sorted[j])
+				}
+			}
+		}
+	}
+}
+
+func TestSearchBox(t *testing.T) {
+	rand.Seed(22)
+	x := randomPoints(3000)
+	// Points on the faces of the box test the half-open boundaries.
+	x = append(x, [3]float64{ 0.2, 0.5, 0.5 }, [3]float64{ 0.7, 0.5, 0.5 })
+	tree, ot := NewTree(x), NewOctree(x)
+
+	spans := [][2][3]float64{
+		{ {0.2, 0.1, 0.3}, {0.7, 0.6, 0.9} },
+		{ {-1, -1, -1}, {2, 2, 2} },
+		{ {0.5, 0.5, 0.5}, {0.5, 0.6, 0.7} },
+		{ {2, 2, 2}, {3, 3, 3} },
+	}
+
+	buf := []int{ }
+	for i := range spans {
+		span := spans[i]
+		buf = tree.SearchBox(span, buf)
+		checkSearch(t, "SearchBox", i, x, buf, func(x *[3]float64) bool {
+			return inBox(x, &span)
+		})
+		checkSearch(t, "Octree.SearchBox", i, x, ot.SearchBox(span),
+			func(x *[3]float64) bool { return inBox(x, &span) })
+	}
+
+	if found := NewTree(nil).SearchBox(spans[1]); len(found) != 0 {
+		t.Errorf("Empty tree found %v.", found)
+	}
+}
+
+func TestSearchCylinder(t *testing.T) {
+	rand.Seed(23)
+	x := randomPoints(3000)
+	tree, ot := NewTree(x), NewOctree(x)
+
+	tests := []struct {
+		x0, x1 [3]float64
+		r float64
+	}{
+		{ [3]float64{0.5, 0.5, -1}, [3]float64{0.5, 0.5, 2}, 0.2 },
+		{ [3]float64{0.1, 0.2, 0.3}, [3]float64{0.9, 0.7, 0.6}, 0.1 },
+		{ [3]float64{0.5, 0.5, 0.5}, [3]float64{0.5, 0.5, 0.5}, 0.3 },
+		{ [3]float64{-1, -1, -1}, [3]float64{2, 2, 2}, 5 },
+	}
+
+	for i := range tests {
+		r2 := tests[i].r*tests[i].r
+		in := func(x *[3]float64) bool {
+			// Brute force: the nearest point on the segment is within r, and
+			// the point's projection is between the ends.
+			s, l2, d2 := 0.0, 0.0, 0.0
+			for k := 0; k < 3; k++ {
+				dir := tests[i].x1[k] - tests[i].x0[k]
+				s += (x[k] - tests[i].x0[k])*dir
+				l2 += dir*dir
+			}
+			// Zero-length cylinders have no volume.
+			if l2 == 0 { return false }
+			s /= l2
+			if s < 0 || s > 1 { return false }
+			for k := 0; k < 3; k++ {
+				d := x[k] - (tests[i].x0[k] +
+					s*(tests[i].x1[k] - tests[i].x0[k]))
+				d2 += d*d
+			}
+			return d2 < r2
+		}
+
+		checkSearch(t, "SearchCylinder", i, x, tree.SearchCylinder(
+			tests[i].x0, tests[i].x1, tests[i].r), in)
+		checkSearch(t, "Octree.SearchCylinder", i, x, ot.SearchCylinder(
+			tests[i].x0, tests[i].x1, tests[i].r), in)
+	}
+
+	// A zero-length cylinder isn't a sphere search.
+	pt := [3]float64{ 0.5, 0.5, 0.5 }
+	if found := tree.SearchCylinder(pt, pt, 0.3); len(found) != 0 {
+		t.Errorf("Zero-length cylinder found %d points.", len(found))
+	}
+
+	empty := NewTree(nil)
+	if found := empty.SearchCylinder(tests[3].x0, tests[3].x1,
+		tests[3].r); len(found) != 0 {
+		t.Errorf("Empty tree found %v.", found)
+	}
+}
+
+// checkSearch compares the results of a search against a brute force test.
+func checkSearch(
+	t *testing.T, name string, i int, x [][3]float64, found []int,
+	in func(x *[3]float64) bool,
+) {
+	ok := make([]bool, len(x))
+	for _, j := range found {
+		if ok[j] {
+			t.Errorf("%d) %s returned %d twice.", i, name, j)
+		}
+		ok[j] = true
+	}
+	for j := range x {
+		if ok[j] != in(&x[j]) {
+			t.Errorf("%d) %s gave %v for point %d, %v.",
+				i, name, ok[j], j, x[j])
+			return
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package gravitree
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ProfileOptions customizes NewRadialProfile. Zero values are replaced by
+// their defaults.
+type ProfileOptions struct {
+	// Center and VCenter are the position and bulk velocity of the halo.
+	// Default: the origin and zero.
+	Center, VCenter [3]float64
+	// RMin and RMax are the edges of the innermost and outermost bins.
+	// Default: the smallest non-zero radius and the largest radius.
+	RMin, RMax float64
+	// Bins is the number of logarithmic radial bins. Default: 50
+	Bins int
+	// Mass is the mass of each particle. If it's nil, every particle has a
+	// mass of ParticleMass, which defaults to 1.
+	Mass []float64
+	ParticleMass float64
+	// G is the gravitational constant. Default: 1, the code units used by
+	// the integrator.
+	G float64
+}
+
+// RadialProfile contains spherically averaged profiles of a halo in
+// logarithmic radial bins. Bin b covers radii [Edges[b], Edges[b+1]), except
+// for the last bin, which also includes Edges[Bins] so that the default RMax
+// keeps the outermost particle. The lookup methods interpolate between bins
+// linearly in log(r), except for EnclosedMass and GetCircularVelocity, which
+// are exact. If the radial range can't be inferred from the particles (e.g.
+// there's only one distinct non-zero radius), the profile has no bins and
+// only the exact lookups can be used.
+type RadialProfile struct {
+	Edges []float64 // len(Edges) = Bins + 1, or 0 without bins.
+	R []float64 // The geometric centers of the bins.
+	Count []int // Number of particles in each bin.
+	Rho []float64 // Mass in each bin divided by the bin's volume.
+
+	// MEnc and VCirc are the enclosed mass and circular velocity at the
+	// outer edge of each bin, Edges[b+1].
+	MEnc, VCirc []float64
+
+	// SigmaR is the radial velocity dispersion and SigmaT is the 1D
+	// tangential dispersion, sqrt((sigma_theta^2 + sigma_phi^2)/2), with
+	// angles measured from the z-axis. Sigma is the 1D dispersion,
+	// sqrt((SigmaR^2 + 2 SigmaT^2)/3), and Beta is the anisotropy,
+	// 1 - SigmaT^2/SigmaR^2. Dispersions are mass-weighted and are NaN in
+	// empty bins.
+	SigmaR, SigmaT, Sigma, Beta []float64
+
+	G float64
+
+	radii []float64 // Sorted particle radii.
+	cumMass []float64 // cumMass[k] is the mass of the k innermost particles.
+}
+
+// NewRadialProfile bins the particles with positions x and velocities v in
+// log radius around a center and computes their profiles. v may be nil, in
+// which case the dispersions are left empty. Building a profile takes
+// O(N log N) time, after which each lookup takes O(log N) time or less.
+func NewRadialProfile(
+	x, v [][3]float64, opt ...ProfileOptions,
+) *RadialProfile {
+	o := ProfileOptions{ }
+	if len(opt) > 0 { o = opt[0] }
+	if o.Bins == 0 { o.Bins = 50 }
+	if o.ParticleMass == 0 { o.ParticleMass = 1 }
+	if o.G == 0 { o.G = 1 }
+	if v != nil && len(v) != len(x) {
+		panic(fmt.Sprintf("len(x) = %d, but len(v) = %d", len(x), len(v)))
+	} else if o.Mass != nil && len(o.Mass) != len(x) {
+		panic(fmt.Sprintf("len(x) = %d, but len(Mass) = %d",
+			len(x), len(o.Mass)))
+	} else if o.Bins < 0 {
+		panic(fmt.Sprintf("Bins must be positive, got %d.", o.Bins))
+	} else if o.RMin < 0 || o.RMax < 0 ||
+		(o.RMin != 0 && o.RMax != 0 && o.RMax <= o.RMin) {
+		panic(fmt.Sprintf("Invalid profile range: RMin = %g, RMax = %g.",
+			o.RMin, o.RMax))
+	}
+	mass := func(i int) float64 {
+		if o.Mass == nil { return o.ParticleMass }
+		return o.Mass[i]
+	}
+
+	r := make([]float64, len(x))
+	order := make([]int, len(x))
+	for i := range x {
+		r[i], order[i] = math.Sqrt(calcR2(&x[i], &o.Center)), i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return r[order[a]] < r[order[b]]
+	})
+
+	p := &RadialProfile{ G: o.G, radii: make([]float64, len(x)),
+		cumMass: make([]float64, len(x) + 1) }
+	for k, i := range order {
+		p.radii[k] = r[i]
+		p.cumMass[k + 1] = p.cumMass[k] + mass(i)
+	}
+
+	if o.RMin == 0 {
+		k := sort.Search(len(p.radii), func(k int) bool {
+			return p.radii[k] > 0
+		})
+		if k < len(p.radii) { o.RMin = p.radii[k] }
+	}
+	if o.RMax == 0 && len(p.radii) > 0 { o.RMax = p.radii[len(p.radii) - 1] }
+
+	// If the range can't be inferred (e.g. every particle is at the same
+	// radius), there are no bins, but the exact lookups still work.
+	if o.RMin <= 0 || o.RMax <= o.RMin { return p }
+
+	p.Edges = LogBins(o.RMin, o.RMax, o.Bins)
+	p.binParticles(x, v, r, mass, o)
+
+	return p
+}
+
+// binParticles computes the binned profiles of p.
+func (p *RadialProfile) binParticles(
+	x, v [][3]float64, r []float64, mass func(int) float64,
+	o ProfileOptions,
+) {
+	n := len(p.Edges) - 1
+	p.R, p.Count = make([]float64, n), make([]int, n)
+	p.Rho = make([]float64, n)
+	p.MEnc, p.VCirc = make([]float64, n), make([]float64, n)
+
+	// Mass-weighted sums of 1, v_r, v_r^2, v_theta, v_theta^2, v_phi,
+	// v_phi^2.
+	sums := make([][7]float64, n)
+	dlr := math.Log(p.Edges[n]/p.Edges[0]) / float64(n)
+	for i := range x {
+		if r[i] < p.Edges[0] || r[i] > p.Edges[n] { continue }
+		b := int(math.Log(r[i]/p.Edges[0]) / dlr)
+		if b >= n { b = n - 1 }
+		// Rounding can put points just past an edge.
+		if b > 0 && r[i] < p.Edges[b] { b-- }
+		if b < n - 1 && r[i] >= p.Edges[b + 1] { b++ }
+
+		m := mass(i)
+		p.Count[b]++
+		sums[b][0] += m
+		if v == nil { continue }
+
+		vr, vt, vp := sphericalVelocity(x[i], v[i], o.Center, o.VCenter)
+		sums[b][1] += m*vr
+		sums[b][2] += m*vr*vr
+		sums[b][3] += m*vt
+		sums[b][4] += m*vt*vt
+		sums[b][5] += m*vp
+		sums[b][6] += m*vp*vp
+	}
+
+	for b := 0; b < n; b++ {
+		r0, r1 := p.Edges[b], p.Edges[b + 1]
+		p.R[b] = math.Sqrt(r0*r1)
+		p.Rho[b] = sums[b][0] / (4*math.Pi/3 * (r1*r1*r1 - r0*r0*r0))
+		p.MEnc[b] = p.EnclosedMass(r1)
+		p.VCirc[b] = p.GetCircularVelocity(r1)
+	}
+
+	if v == nil { return }
+
+	p.SigmaR, p.SigmaT = make([]float64, n), make([]float64, n)
+	p.Sigma, p.Beta = make([]float64, n), make([]float64, n)
+	for b := 0; b < n; b++ {
+		s := &sums[b]
+		if s[0] == 0 {
+			p.SigmaR[b], p.SigmaT[b] = math.NaN(), math.NaN()
+			p.Sigma[b], p.Beta[b] = math.NaN(), math.NaN()
+			continue
+		}
+
+		sr2 := variance(s[0], s[1], s[2])
+		st2 := (variance(s[0], s[3], s[4]) + variance(s[0], s[5], s[6]))/2
+		p.SigmaR[b], p.SigmaT[b] = math.Sqrt(sr2), math.Sqrt(st2)
+		p.Sigma[b] = math.Sqrt((sr2 + 2*st2)/3)
+		p.Beta[b] = 1 - st2/sr2
+	}
+}
+
+// variance returns the variance of a quantity from its weighted sums: the
+// total weight, w, sum of w*x, and sum of w*x^2.
+func variance(w, wx, wx2 float64) float64 {
+	mean := wx/w
+	return math.Max(wx2/w - mean*mean, 0)
+}
+
+// sphericalVelocity returns the radial, polar, and azimuthal components of
+// a velocity, v, at the position x relative to the center. The angles are
+// measured from the z-axis.
+func sphericalVelocity(
+	x, v, center, vCenter [3]float64,
+) (vr, vTheta, vPhi float64) {
+	dx, dv := [3]float64{ }, [3]float64{ }
+	for k := 0; k < 3; k++ {
+		dx[k], dv[k] = x[k] - center[k], v[k] - vCenter[k]
+	}
+
+	R := math.Sqrt(dx[0]*dx[0] + dx[1]*dx[1])
+	r := math.Sqrt(R*R + dx[2]*dx[2])
+	if r == 0 { return 0, 0, 0 }
+
+	cosPhi, sinPhi := 1.0, 0.0
+	if R > 0 { cosPhi, sinPhi = dx[0]/R, dx[1]/R }
+	cosTheta, sinTheta := dx[2]/r, R/r
+
+	vr = sinTheta*(cosPhi*dv[0] + sinPhi*dv[1]) + cosTheta*dv[2]
+	vTheta = cosTheta*(cosPhi*dv[0] + sinPhi*dv[1]) - sinTheta*dv[2]
+	vPhi = -sinPhi*dv[0] + cosPhi*dv[1]
+	return vr, vTheta, vPhi
+}
+
+// EnclosedMass returns the mass of the particles within r of the center,
+// including those at exactly r.
+func (p *RadialProfile) EnclosedMass(r float64) float64 {
+	k := sort.Search(len(p.radii), func(k int) bool { return p.radii[k] > r })
+	return p.cumMass[k]
+}
+
+// GetCircularVelocity returns the circular velocity, sqrt(G M(<r)/r), at r.
+func (p *RadialProfile) GetCircularVelocity(r float64) float64 {
+	return math.Sqrt(p.G * p.EnclosedMass(r) / r)
+}
+
+// DensityAt returns the density at r, interpolated from Rho.
+func (p *RadialProfile) DensityAt(r float64) float64 {
+	return p.interpolate(p.Rho, r)
+}
+
+// SigmaRAt returns the radial velocity dispersion at r, interpolated from
+// SigmaR.
+func (p *RadialProfile) SigmaRAt(r float64) float64 {
+	return p.interpolate(p.SigmaR, r)
+}
+
+// SigmaTAt returns the 1D tangential velocity dispersion at r, interpolated
+// from SigmaT.
+func (p *RadialProfile) SigmaTAt(r float64) float64 {
+	return p.interpolate(p.SigmaT, r)
+}
+
+// SigmaAt returns the 1D velocity dispersion at r, interpolated from Sigma.
+func (p *RadialProfile) SigmaAt(r float64) float64 {
+	return p.interpolate(p.Sigma, r)
+}
+
+// BetaAt returns the velocity anisotropy at r, interpolated from Beta.
+func (p *RadialProfile) BetaAt(r float64) float64 {
+	return p.interpolate(p.Beta, r)
+}
+
+// interpolate linearly interpolates y, which is tabulated at the bin centers,
+// in log(r). Radii outside the bin centers get the value of the nearest bin.
+func (p *RadialProfile) interpolate(y []float64, r float64) float64 {
+	if len(p.R) == 0 {
+		panic("Profile has no bins, so only EnclosedMass and " +
+			"GetCircularVelocity can be used.")
+	} else if len(y) == 0 {
+		panic("Profile wasn't computed. Velocities are needed for " +
+			"dispersions.")
+	}
+
+	n := len(p.R)
+	if r <= p.R[0] {
+		return y[0]
+	} else if r >= p.R[n - 1] {
+		return y[n - 1]
+	}
+
+	// Bin centers are evenly spaced in log(r).
+	dlr := math.Log(p.R[n - 1]/p.R[0]) / float64(n - 1)
+	f := math.Log(r/p.R[0]) / dlr
+	b := int(f)
+	if b >= n - 1 { b = n - 2 }
+	f -= float64(b)
+	return y[b]*(1 - f) + y[b + 1]*f
+}
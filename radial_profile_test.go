@@ -0,0 +1,123 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestRadialProfile(t *testing.T) {
+	rand.Seed(50)
+	n := 50000
+	x, v := plummerSphere(n)
+	// Shift the sphere to check that the center is used.
+	center, vCenter := [3]float64{ 1, 2, 3 }, [3]float64{ -1, 0, 1 }
+	for i := range x {
+		for k := 0; k < 3; k++ { x[i][k], v[i][k] = x[i][k] + center[k],
+			v[i][k] + vCenter[k] }
+	}
+
+	mp := 1/float64(n)
+	prof := NewRadialProfile(x, v, ProfileOptions{ Center: center,
+		VCenter: vCenter, RMin: 0.05, RMax: 5, Bins: 30, ParticleMass: mp })
+
+	// Enclosed masses and circular velocities are exact.
+	dx := make([][3]float64, n)
+	for i := range x {
+		for k := 0; k < 3; k++ { dx[i][k] = x[i][k] - center[k] }
+	}
+	for _, r := range []float64{ 0.01, 0.3, 1, 4, 20 } {
+		expV := GetCircularVelocity(dx, r, mp)
+		if m, expM := prof.EnclosedMass(r),
+			float64(GetParticleCount(dx, r))*mp; !almostEq(m, expM, 1e-12) {
+			t.Errorf("M(<%g) = %g, expected %g.", r, m, expM)
+		}
+		if vc := prof.GetCircularVelocity(r); !almostEq(vc, expV, 1e-12) {
+			t.Errorf("Vc(%g) = %g, expected %g.", r, vc, expV)
+		}
+	}
+
+	// The truncated sphere has a total mass of 1, not M(<10).
+	plummer := &Plummer{ B: 1 }
+	mTrunc := plummer.EnclosedMass(10)
+	for b, r := range prof.R {
+		// Inner bins have too few particles for tight tolerances.
+		if r < 0.5 || r > 3 { continue }
+		rho := 3/(4*math.Pi) * math.Pow(1 + r*r, -2.5) / mTrunc
+		sigma := math.Sqrt(1 / (6*math.Sqrt(1 + r*r)))
+		if math.Abs(prof.Rho[b]/rho - 1) > 0.1 {
+			t.Errorf("rho(%.3f) = %.4g, expected %.4g.", r, prof.Rho[b], rho)
+		}
+		if math.Abs(prof.SigmaR[b]/sigma - 1) > 0.08 ||
+			math.Abs(prof.SigmaT[b]/sigma - 1) > 0.08 ||
+			math.Abs(prof.Sigma[b]/sigma - 1) > 0.08 {
+			t.Errorf("sigma(%.3f) = %.4g (r), %.4g (t), %.4g, expected %.4g.",
+				r, prof.SigmaR[b], prof.SigmaT[b], prof.Sigma[b], sigma)
+		}
+		if math.Abs(prof.Beta[b]) > 0.15 {
+			t.Errorf("beta(%.3f) = %.3f, expected 0.", r, prof.Beta[b])
+		}
+	}
+
+	// Lookups interpolate between bin centers in log(r).
+	for b := 0; b + 1 < len(prof.R); b++ {
+		if rho := prof.DensityAt(prof.R[b]); !almostEq(rho, prof.Rho[b],
+			1e-9*prof.Rho[b]) {
+			t.Errorf("DensityAt(R[%d]) = %g, but Rho[%d] = %g.",
+				b, rho, b, prof.Rho[b])
+		}
+		r := math.Sqrt(prof.R[b]*prof.R[b + 1])
+		exp := (prof.Beta[b] + prof.Beta[b + 1])/2
+		if beta := prof.BetaAt(r); !almostEq(beta, exp, 1e-9) {
+			t.Errorf("BetaAt(%g) = %g, expected %g.", r, beta, exp)
+		}
+	}
+	if rho := prof.DensityAt(1e-5); rho != prof.Rho[0] {
+		t.Errorf("DensityAt(1e-5) = %g, expected %g.", rho, prof.Rho[0])
+	}
+
+	// Purely radial orbits have Beta = 1.
+	for i := range v {
+		r, vr := math.Sqrt(calcR2(&dx[i], &[3]float64{ })), rand.NormFloat64()
+		for k := 0; k < 3; k++ { v[i][k] = vr*dx[i][k]/r }
+	}
+	prof = NewRadialProfile(dx, v, ProfileOptions{ RMin: 0.05, RMax: 5 })
+	for b := range prof.Beta {
+		if !almostEq(prof.Beta[b], 1, 1e-9) {
+			t.Errorf("Radial orbits have beta(%.3f) = %g.",
+				prof.R[b], prof.Beta[b])
+		}
+	}
+}
+
+func TestRadialProfileDegenerate(t *testing.T) {
+	// Binning is impossible, but the exact lookups still match the O(N)
+	// functions.
+	inputs := [][][3]float64{
+		{ }, { { 1, 0, 0 } }, { { 0, 0, 0 }, { 0, 0, 0 } },
+		{ { 0, 0, 0 }, { 0, 2, 0 }, { 0, 0, -2 } },
+	}
+	for i, x := range inputs {
+		prof := NewRadialProfile(x, nil)
+		if len(prof.Edges) != 0 || len(prof.R) != 0 {
+			t.Errorf("%d) Expected no bins, got edges %v.", i, prof.Edges)
+		}
+		for _, r := range []float64{ 0.5, 1, 2, 3 } {
+			m, expM := prof.EnclosedMass(r), float64(GetParticleCount(x, r))
+			vc := prof.GetCircularVelocity(r)
+			expV := GetCircularVelocity(x, r, 1)
+			if m != expM || !almostEq(vc, expV, 1e-12) {
+				t.Errorf("%d) M(<%g) = %g and Vc = %g, expected %g and %g.",
+					i, r, m, vc, expM, expV)
+			}
+		}
+	}
+
+	// Particles at exactly RMax are in the last bin.
+	x := [][3]float64{ { 1, 0, 0 }, { 2, 0, 0 }, { 4, 0, 0 } }
+	prof := NewRadialProfile(x, nil, ProfileOptions{ RMin: 1, RMax: 4,
+		Bins: 2 })
+	if prof.Count[0] != 1 || prof.Count[1] != 2 {
+		t.Errorf("Expected bin counts of [1 2], got %v.", prof.Count)
+	}
+}
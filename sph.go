@@ -0,0 +1,85 @@
+package gravitree
+
+import (
+	"fmt"
+	"math"
+)
+
+// SPHOptions customizes SPHDensity. Zero values are replaced by their
+// defaults.
+type SPHOptions struct {
+	// K is the number of neighbors used to find each smoothing length,
+	// including the particle itself. Default: 32
+	K int
+	// Mass is the mass of each particle in input order. Default: every
+	// particle has a mass of 1, so densities are number densities.
+	Mass []float64
+}
+
+// SPHDensity returns the SPH density, rho, and the smoothing length, h, of
+// every point in t, both in input order. h is the distance to a point's K-th
+// nearest neighbor and rho is the sum of its K nearest neighbors' masses,
+// weighted by the cubic spline kernel of Monaghan & Lattanzio (1985) with
+// compact support at h (the convention used by Gadget). Points with h = 0,
+// i.e. with K duplicates, have infinite densities. The points are split
+// between workers.
+//
+// Like all SPH densities, rho includes each point's own mass. For randomly
+// sampled points this biases rho high by a factor of about
+// 1 + 32/(3(K - 2)), so K should be large when unbiased densities matter.
+func (t *Tree) SPHDensity(opt ...SPHOptions) (rho, h []float64) {
+	return sphDensity(t.spatialIndex(), opt...)
+}
+
+// sphDensity is the same as SPHDensity, except that it walks any
+// SpatialIndex.
+func sphDensity(idx SpatialIndex, opt ...SPHOptions) (rho, h []float64) {
+	t := idx.Base()
+	o := SPHOptions{ }
+	if len(opt) > 0 { o = opt[0] }
+	if o.K == 0 { o.K = 32 }
+	if o.K < 0 {
+		panic(fmt.Sprintf("K must be positive, got %d.", o.K))
+	} else if o.Mass != nil && len(o.Mass) != len(t.Points) {
+		panic(fmt.Sprintf("len(Mass) = %d, but the tree has %d points.",
+			len(o.Mass), len(t.Points)))
+	}
+
+	rho, h = make([]float64, len(t.Points)), make([]float64, len(t.Points))
+	bufs := make([]*KNearestBuffer, nWorkers)
+	for w := range bufs { bufs[w] = &KNearestBuffer{ } }
+
+	runBatchQueries(len(t.Points), func(worker, j int) {
+		found, r2 := kNearest(idx, t.Points[j], o.K, bufs[worker])
+		i := t.Index[j]
+		h[i] = math.Sqrt(r2[len(r2) - 1])
+		if h[i] == 0 {
+			rho[i] = math.Inf(+1)
+			return
+		}
+
+		for n := range found {
+			w := cubicSplineKernel(math.Sqrt(r2[n]), h[i])
+			if o.Mass == nil {
+				rho[i] += w
+			} else {
+				rho[i] += w*o.Mass[found[n]]
+			}
+		}
+	})
+
+	return rho, h
+}
+
+// cubicSplineKernel returns the cubic spline SPH kernel at r for a smoothing
+// length h > 0. The kernel is zero at r >= h and integrates to 1.
+func cubicSplineKernel(r, h float64) float64 {
+	q := r / h
+	norm := 8 / (math.Pi*h*h*h)
+	if q <= 0.5 {
+		return norm * (1 - 6*q*q + 6*q*q*q)
+	} else if q < 1 {
+		return norm * 2*(1 - q)*(1 - q)*(1 - q)
+	}
+	return 0
+}
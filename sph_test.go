@@ -0,0 +1,75 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestCubicSplineKernel(t *testing.T) {
+	// Integrate 4 pi r^2 W(r) dr with the midpoint rule.
+	h, n, sum := 0.7, 10000, 0.0
+	for i := 0; i < n; i++ {
+		r := h*(float64(i) + 0.5)/float64(n)
+		sum += 4*math.Pi*r*r*cubicSplineKernel(r, h) * h/float64(n)
+	}
+	if math.Abs(sum - 1) > 1e-6 {
+		t.Errorf("Kernel integrates to %g, not 1.", sum)
+	}
+}
+
+func TestSPHDensity(t *testing.T) {
+	rand.Seed(48)
+	n, k := 20000, 40
+	x := randomPoints(n)
+	mass := make([]float64, n)
+	for i := range mass { mass[i] = 1 + rand.Float64() }
+
+	rho, h := NewTree(x).SPHDensity(SPHOptions{ K: k })
+	rhoM, hM := NewTree(x).SPHDensity(SPHOptions{ K: k, Mass: mass })
+	rhoO, _ := NewOctree(x).SPHDensity(SPHOptions{ K: k })
+
+	// Check a few points by brute force.
+	for _, i := range []int{ 0, 17, n/2, n - 1 } {
+		r := make([]float64, n)
+		for j := range x { r[j] = math.Sqrt(calcR2(&x[i], &x[j])) }
+		order := make([]int, n)
+		for j := range order { order[j] = j }
+		sort.Slice(order, func(a, b int) bool {
+			return r[order[a]] < r[order[b]]
+		})
+
+		expH, expRho, expRhoM := r[order[k - 1]], 0.0, 0.0
+		for _, j := range order[:k] {
+			w := cubicSplineKernel(r[j], expH)
+			expRho, expRhoM = expRho + w, expRhoM + w*mass[j]
+		}
+		if !almostEq(h[i], expH, 1e-12) || !almostEq(hM[i], expH, 1e-12) {
+			t.Errorf("%d) h = %g, expected %g.", i, h[i], expH)
+		}
+		if !almostEq(rho[i]/expRho, 1, 1e-10) ||
+			!almostEq(rhoO[i]/expRho, 1, 1e-10) {
+			t.Errorf("%d) rho = %g (octree: %g), expected %g.",
+				i, rho[i], rhoO[i], expRho)
+		}
+		if !almostEq(rhoM[i]/expRhoM, 1, 1e-10) {
+			t.Errorf("%d) rho with masses = %g, expected %g.",
+				i, rhoM[i], expRhoM)
+		}
+	}
+
+	// Points away from the edges of the box should have densities near n,
+	// with the bias from each point's own mass.
+	mean, count := 0.0, 0
+	for i := range x {
+		if boxDist2(&x[i], &[2][3]float64{ { 0.1, 0.1, 0.1 },
+			{ 0.9, 0.9, 0.9 } }) > 0 { continue }
+		mean, count = mean + rho[i], count + 1
+	}
+	mean /= float64(count)
+	exp := float64(n) * (1 + 32/(3*float64(k - 2)))
+	if math.Abs(mean/exp - 1) > 0.02 {
+		t.Errorf("Mean interior density is %g, expected %g.", mean, exp)
+	}
+}
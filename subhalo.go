@@ -0,0 +1,145 @@
+package gravitree
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// SubhaloOptions customizes FindSubhalos. Zero values are replaced by their
+// defaults.
+type SubhaloOptions struct {
+	// LinkFraction is the fraction of a group's particles which are linked to
+	// at least one other particle when it's split. Default: 0.7, the value
+	// used by ROCKSTAR.
+	LinkFraction float64
+	// MinMembers is the smallest number of particles in a subgroup.
+	// Default: 20
+	MinMembers int
+}
+
+// Subhalo is a group of particles found by FindSubhalos.
+type Subhalo struct {
+	// Parent is the index of the group which contains this one, or -1 for
+	// the input FoF groups. Level is the number of parents above the group.
+	Parent, Level int
+	// Members are the original indices of the particles in the group, in
+	// increasing order.
+	Members []int
+	// XScale and VScale are the position and velocity dispersions of the
+	// members, which set the group's phase-space metric.
+	XScale, VScale float64
+	// B is the scaled linking length used to split the group into its
+	// children.
+	B float64
+}
+
+// FindSubhalos finds substructure within FoF groups in the style of ROCKSTAR.
+// Each group is split with a 6D FoF search in a phase-space metric scaled by
+// the group's own position and velocity dispersions. The linking length is
+// chosen so that a fraction, LinkFraction, of the particles have a neighbor
+// within it. The subgroups are split again in the same way until no more
+// subgroups with at least MinMembers particles are found.
+//
+// Subhalos are returned with parents before their children and with the
+// children of each group sorted from largest to smallest. The groups without
+// children are the densest phase-space cores. The positions and velocities of
+// a Subhalo's members (see Points) can be passed to IterativeBindingEnergy to
+// remove unbound particles.
+func FindSubhalos(
+	x, v [][3]float64, groups *FoFGroups, opt ...SubhaloOptions,
+) []Subhalo {
+	if len(x) != len(v) || len(x) != len(groups.ID) {
+		panic(fmt.Sprintf("len(x) = %d, len(v) = %d, and len(groups.ID) " +
+			"= %d must be equal.", len(x), len(v), len(groups.ID)))
+	}
+
+	o := SubhaloOptions{ }
+	if len(opt) > 0 { o = opt[0] }
+	if o.LinkFraction == 0 { o.LinkFraction = 0.7 }
+	if o.MinMembers == 0 { o.MinMembers = 20 }
+	if o.LinkFraction < 0 || o.LinkFraction > 1 {
+		panic(fmt.Sprintf("LinkFraction must be in (0, 1], got %g.",
+			o.LinkFraction))
+	}
+
+	subs := make([]Subhalo, len(groups.Sizes))
+	for g := range subs {
+		subs[g] = Subhalo{ Parent: -1,
+			Members: make([]int, 0, groups.Sizes[g]) }
+	}
+	for i, g := range groups.ID {
+		if g >= 0 { subs[g].Members = append(subs[g].Members, i) }
+	}
+
+	// Children are appended to the end of subs, so this is a breadth-first
+	// search.
+	xs, vs := [][3]float64{ }, [][3]float64{ }
+	tree := &PhaseTree{ }
+	for s := 0; s < len(subs); s++ {
+		members := subs[s].Members
+		xs, vs = gatherPoints(x, members, xs), gatherPoints(v, members, vs)
+		subs[s].XScale, subs[s].VScale = dispersion(xs), dispersion(vs)
+		if len(members) <= o.MinMembers { continue }
+
+		xScale, vScale := subs[s].XScale, subs[s].VScale
+		if xScale == 0 { xScale = 1 }
+		if vScale == 0 { vScale = 1 }
+		tree = NewPhaseTree(xs, vs, xScale, vScale, tree.Reuse())
+
+		subs[s].B = linkingLength(tree, o.LinkFraction)
+		children := tree.FriendsOfFriends(subs[s].B, o.MinMembers)
+
+		start := len(subs)
+		for _, size := range children.Sizes {
+			subs = append(subs, Subhalo{ Parent: s, Level: subs[s].Level + 1,
+				Members: make([]int, 0, size) })
+		}
+		for j, c := range children.ID {
+			if c >= 0 {
+				subs[start + c].Members = append(
+					subs[start + c].Members, members[j])
+			}
+		}
+	}
+
+	return subs
+}
+
+// Points returns the positions and velocities of the subhalo's members.
+func (s *Subhalo) Points(x, v [][3]float64) (xs, vs [][3]float64) {
+	return gatherPoints(x, s.Members, nil), gatherPoints(v, s.Members, nil)
+}
+
+// gatherPoints returns x[idx[0]], x[idx[1]], ..., reusing buf.
+func gatherPoints(x [][3]float64, idx []int, buf [][3]float64) [][3]float64 {
+	buf = buf[:0]
+	for _, i := range idx { buf = append(buf, x[i]) }
+	return buf
+}
+
+// dispersion returns the root-mean-square distance of x from its mean.
+func dispersion(x [][3]float64) float64 {
+	if len(x) == 0 { return 0 }
+	mean := centerOfMass(x)
+	sum := 0.0
+	for i := range x { sum += calcR2(&x[i], &mean) }
+	return math.Sqrt(sum / float64(len(x)))
+}
+
+// linkingLength returns the distance within which the given fraction of the
+// points in t have their nearest neighbor.
+func linkingLength(t *PhaseTree, fraction float64) float64 {
+	bufs := make([]*KNearestBuffer, nWorkers)
+	for w := range bufs { bufs[w] = &KNearestBuffer{ } }
+
+	nn := make([]float64, len(t.Points))
+	runBatchQueries(len(t.Points), func(worker, j int) {
+		// The nearest point is j itself.
+		_, r2 := t.KNearest(t.Points[j], 2, bufs[worker])
+		nn[j] = math.Sqrt(r2[len(r2) - 1])
+	})
+
+	sort.Float64s(nn)
+	return percentile(nn, fraction)
+}
@@ -0,0 +1,89 @@
+package gravitree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestFindSubhalos(t *testing.T) {
+	rand.Seed(48)
+
+	// A host halo with a subhalo which is compact in position and moving
+	// with a bulk velocity.
+	nHost, nSub := 20000, 1000
+	x := make([][3]float64, nHost + nSub)
+	v := make([][3]float64, nHost + nSub)
+	for i := range x {
+		for k := 0; k < 3; k++ {
+			if i < nHost {
+				x[i][k], v[i][k] = rand.NormFloat64(), rand.NormFloat64()
+			} else {
+				x[i][k] = 0.05*rand.NormFloat64()
+				v[i][k] = 0.1*rand.NormFloat64()
+			}
+		}
+		if i >= nHost { x[i][0], v[i][0] = x[i][0] + 0.5, v[i][0] + 2 }
+	}
+
+	groups := NewTree(x).FriendsOfFriends(1, 20)
+	subs := FindSubhalos(x, v, groups)
+	if len(subs) < len(groups.Sizes) {
+		t.Fatalf("Found %d subhalos, but there are %d FoF groups.",
+			len(subs), len(groups.Sizes))
+	}
+
+	found := false
+	for s := range subs {
+		sub := &subs[s]
+		if sub.Parent == -1 {
+			if s >= len(groups.Sizes) || sub.Level != 0 ||
+				len(sub.Members) != groups.Sizes[s] {
+				t.Errorf("Subhalo %d doesn't match FoF group %d.", s, s)
+			}
+		} else {
+			p := &subs[sub.Parent]
+			if sub.Parent >= s || sub.Level != p.Level + 1 ||
+				len(sub.Members) < 20 || len(sub.Members) >= len(p.Members) {
+				t.Errorf("Subhalo %d has %d members at level %d, but its " +
+					"parent, %d, has %d members at level %d.", s,
+					len(sub.Members), sub.Level, sub.Parent,
+					len(p.Members), p.Level)
+			}
+			if !isSubset(sub.Members, p.Members) {
+				t.Errorf("Subhalo %d isn't a subset of its parent.", s)
+			}
+		}
+
+		// Look for a group that recovers most of the subhalo without much
+		// of the host.
+		nIn := 0
+		for _, i := range sub.Members {
+			if i >= nHost { nIn++ }
+		}
+		if sub.Level > 0 && nIn > nSub/2 && nIn > 9*len(sub.Members)/10 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("The subhalo wasn't recovered by any of the %d groups.",
+			len(subs))
+	}
+
+	xs, vs := subs[0].Points(x, v)
+	for j, i := range subs[0].Members {
+		if xs[j] != x[i] || vs[j] != v[i] {
+			t.Fatalf("Points() returned the wrong point for member %d.", j)
+		}
+	}
+}
+
+// isSubset returns true if every element of the sorted slice a is in the
+// sorted slice b.
+func isSubset(a, b []int) bool {
+	j := 0
+	for _, x := range a {
+		for j < len(b) && b[j] < x { j++ }
+		if j == len(b) || b[j] != x { return false }
+	}
+	return true
+}
@@ -73,9 +73,10 @@ func SimulateOrbit(
 	tCirc := make([]float64, len(pos))
 	ok := make([]bool, len(pos))
 
+	prof := gravitree.NewRadialProfile(extPos, nil, gravitree.ProfileOptions{ParticleMass: opt.ParticleMass})
 	for i := 0; i < len(pos); i++ {
 		ok[i] = true
-		tCirc[i] = 2 * math.Pi * utils.GetNorm(pos[i]) / gravitree.GetCircularVelocity(extPos, utils.GetNorm(pos[i]), opt.ParticleMass)
+		tCirc[i] = 2 * math.Pi * utils.GetNorm(pos[i]) / prof.GetCircularVelocity(utils.GetNorm(pos[i]))
 	}
 
 	tree := gravitree.NewTree(extPos)
@@ -174,11 +175,13 @@ func SimulateCircularOrbits(
 	tCirc := make([]float64, npart)
 	ok := make([]bool, npart)
 
+	prof := gravitree.NewRadialProfile(extPos, nil, gravitree.ProfileOptions{ParticleMass: opt.ParticleMass})
 	for i := 0; i < npart; i++ {
 		ok[i] = true
 		pos[i] = [3]float64{r0 + float64(i)*dr, 0, 0}
-		vel[i] = [3]float64{0, gravitree.GetCircularVelocity(extPos, r0+float64(i)*dr, opt.ParticleMass), 0}
-		tCirc[i] = 2 * math.Pi * (r0 + float64(i)*dr) / gravitree.GetCircularVelocity(extPos, r0+float64(i)*dr, opt.ParticleMass)
+		vc := prof.GetCircularVelocity(r0 + float64(i)*dr)
+		vel[i] = [3]float64{0, vc, 0}
+		tCirc[i] = 2 * math.Pi * (r0 + float64(i)*dr) / vc
 	}
 
 	tree := gravitree.NewTree(extPos)
@@ -54,54 +54,10 @@ func main() {
 	fmt.Printf("Leafs: %.3g\n", float64(nl))
 
 
-	nc, nf, nftot := 0, 0, 0
-	for i := range cs.ApproximateCalls {
-		nc += len(cs.ApproximateCalls[i])
-
-		for j := range cs.ApproximateCalls[i] {
-			n := cs.Sizes2[cs.ApproximateCalls[i][j].I2]
-			
-			nf += n
-		}		
-	}
-	nftot += nf
-
-	fmt.Printf("Approximate() calls: %.3g force evaluations: %.3g\n",
-		float64(nc), float64(nf))
-
-	nc, nf = 0, 0
-	for i := range cs.OneSidedLeafCalls {
-		nc += len(cs.OneSidedLeafCalls[i])
-		for j := range cs.OneSidedLeafCalls[i] {
-			n1 := cs.Sizes1[cs.OneSidedLeafCalls[i][j].I1]
-			n2 := cs.Sizes2[cs.OneSidedLeafCalls[i][j].I2]
-
-			nf += n1*n2
-		}
-	}
-	nftot += nf
-
-	fmt.Printf("OneSidedLeaf() calls: %.3g force evaluations: %.3g\n",
-		float64(nc), float64(nf))
-
-	nc, nf = 0, 0
-
-
-	nc, nf = 0, 0
-	for i := range cs.TwoSidedLeafCalls {
-		nc += len(cs.TwoSidedLeafCalls[i])
-		for j := range cs.TwoSidedLeafCalls[i] {
-			n := cs.Sizes1[cs.TwoSidedLeafCalls[i][j].I1]
-
-			nf += n*(n-1)/2
-		}
-	}
-
-	nftot += nf
-
-	fmt.Printf("TwoSidedLeaf() calls:%.3g force evaluations: %.3g\n",
-		float64(nc), float64(nf))
+	s := cs.Stats()
+	fmt.Print(s)
 
+	nftot := s.TwoSidedLeafEvals + s.OneSidedLeafEvals + s.ApproximateEvals
 	fmt.Printf("Total tree force evaluations: %.3g\n", float64(nftot))
 	fmt.Printf("Tree efficiency: %.3g\n",
 		float64(nftot)/float64(len(x)*(len(x)-1)/2))
@@ -5,32 +5,81 @@ import (
 	"math"
 )
 
-// OpeningCriteria represents a type of criteria used to decide whether a
-// monopole approximation can be used for given tree node.
-type OpeningCriteria int
+// OpeningCriteria decides whether a multipole approximation can be used for
+// a given tree node. The built-in criteria are PKDGRAV3, SalmonWarren, and
+// BarnesHut, and custom criteria can be used by implementing this interface.
+type OpeningCriteria interface {
+	// ROpen2 computes the opening data for node i of t while the tree is
+	// being built. The result is stored in Node.ROpen2. span is the bounding
+	// box of the node's points, and the node's Center, RMax, and RMax2 have
+	// already been computed.
+	ROpen2(t *Tree, i int, span [2][3]float64) float64
+	// UseApproximation returns true if node i1 of t1 can be approximated when
+	// evaluating quantities at the points in node i2 of t2. Only leaf nodes
+	// are used as i2.
+	UseApproximation(t1, t2 *Tree, i1, i2 int) bool
+}
+
+// AdaptiveCriteria is implemented by custom criteria which can be used with
+// Adaptive trees. SupportsAdaptive should only return true if ROpen2 is a
+// squared opening radius and the criteria only promises an error relative to
+// the error of a monopole at that radius, since Adaptive shrinks the radius.
+type AdaptiveCriteria interface {
+	OpeningCriteria
+	SupportsAdaptive() bool
+}
 // ApproximationOrder is the order of the appoximaiton used for unopened tree cells/
 type ApproximationOrder int
 
-const (
-	// The PKDGRAV3 opening criteria (Potter, Stadel, & Teyssier 2017; S 3.1).
-	// This computes R_i for each cell: R_i = R_max/theta, where R_max is
-	// measured relative to the center of mass. Cells are opened if
-	// R < R_target + 1.5*R_i.
-	PKDGRAV3 OpeningCriteria = iota
-	// This criteria is based on maximum-error analysis in Salmon & Warren
-	// (1994), although rederiving it from that paper is tedious. A concise
-	// description can be found in Behroozi, Wechsler, & Wu (2013); Appendix B.
-	SalmonWarren
-	// BarnesHut uses the classical Barnes-Hut opening criteria (Barnes & Hut
-	// 1986). Cells are opened if R > MaxWidth/theta.
-	BarnesHut
+// The PKDGRAV3 opening criteria (Potter, Stadel, & Teyssier 2017; S 3.1).
+// This computes R_i for each cell: R_i = R_max/theta, where R_max is
+// measured relative to the center of mass. Cells are opened if
+// R < R_target + 1.5*R_i.
+type PKDGRAV3Criteria struct{ }
+// This criteria is based on maximum-error analysis in Salmon & Warren
+// (1994), although rederiving it from that paper is tedious. A concise
+// description can be found in Behroozi, Wechsler, & Wu (2013); Appendix B.
+type SalmonWarrenCriteria struct{ }
+// BarnesHutCriteria uses the classical Barnes-Hut opening criteria (Barnes &
+// Hut 1986). Cells are opened if R > MaxWidth/theta.
+type BarnesHutCriteria struct{ }
+
+var (
+	PKDGRAV3 = PKDGRAV3Criteria{ }
+	SalmonWarren = SalmonWarrenCriteria{ }
+	BarnesHut = BarnesHutCriteria{ }
 )
 
 const (
 	Monopole ApproximationOrder = iota
 	Quadrupole
+	Octupole
+	Hexadecapole
 )
 
+// Adaptive chooses the order of each approximation separately. The tree's
+// opening criteria sets the error budget of the monopole approximation
+// through each node's opening radius, R_open. The error of an order-n
+// approximation (n = 0 for a monopole) scales as (R_max/d)^(n+2), so an
+// order-n approximation reaches the same budget at the smaller radius
+//
+//   R_n = R_max (R_open/R_max)^(2/(n+2)).
+//
+// Nodes are only opened within the radius of the highest available order, and
+// each approximation uses the lowest order whose radius is smaller than the
+// minimum distance to the target. This means that cheap monopoles are used
+// far away and higher orders are only used where they save opening a node.
+// Adaptive requires criteria whose ROpen2 is a squared opening radius and
+// which don't promise an absolute error bound, so NewTree panics if it's used
+// with RelativeCriteria, SalmonWarrenAbsolute, or custom criteria which don't
+// implement AdaptiveCriteria.
+const Adaptive ApproximationOrder = -1
+
+// maxAdaptiveOrder is the highest order used by Adaptive. Higher orders would
+// shrink the opening radius to within a few percent of R_max, where the
+// expansion converges too slowly for the error scaling above to hold.
+const maxAdaptiveOrder = Quadrupole
+
 // Tree is a gravitational KD-tree which can be used to compute gravitaional
 // forces and potentials.
 type Tree struct {
@@ -47,8 +96,51 @@ type Tree struct {
 
 	P [][3]float64 // Diagonal matrix used in quadrupole approximation
 	Q [][3][3]float64 // Matrix used in quadrupole approximation
+	// Packed Cartesian moments used by higher order approximations. See
+	// multipole.go for the layout.
+	Multipoles []float64
+
+	// The criteria's opening radii, which are stored here by Adaptive trees
+	// before Node.ROpen2 is shrunk to the radius of the highest order.
+	MonopoleROpen2 []float64
 
 	eps2 float64
+	index SpatialIndex // The index that owns the tree, if it isn't the tree.
+}
+
+// SpatialIndex is a hierarchy of nodes over a set of points. Evaluate,
+// EvaluateAt, and SearchSphere walk a SpatialIndex, so different tree
+// constructions can share them. The index's nodes, points, and moments are
+// stored in the Tree returned by Base. Node 0 must be the root, children must
+// have larger indices than their parents, and leaves must have Left = -1.
+type SpatialIndex interface {
+	Base() *Tree
+	NumChildren(i int) int // The number of children of node i.
+	Child(i, j int) int // The index of the j-th child of node i.
+}
+
+var _ SpatialIndex = &Tree{ } // type-checking
+
+// Base returns t.
+func (t *Tree) Base() *Tree { return t }
+
+// spatialIndex returns the SpatialIndex that t stores the nodes of.
+func (t *Tree) spatialIndex() SpatialIndex {
+	if t.index == nil { return t }
+	return t.index
+}
+
+// NumChildren returns 2 for internal nodes and 0 for leaves.
+func (t *Tree) NumChildren(i int) int {
+	if t.Nodes[i].Left == -1 { return 0 }
+	return 2
+}
+
+// Child returns the Left node of node i for j = 0 and the Right node
+// otherwise.
+func (t *Tree) Child(i, j int) int {
+	if j == 0 { return t.Nodes[i].Left }
+	return t.Nodes[i].Right
 }
 
 // Node is KD-node in a gravitational tree.
@@ -57,13 +149,14 @@ type Node struct {
 	RMax, RMax2, ROpen2 float64 // Radii used to determine cell opening.
 	Left, Right int // The index of the left and right nodes 
 	Start, End int // The indices of the points within the node in Tree.Points.
+	Span [2][3]float64 // The bounding box of the points in the node.
 }
 
 // TreeOptions allows the user to specify advanced options to tune performance
 // and accuracy.
 type TreeOptions struct {
 	LeafSize int // Default: 16
-	Criteria OpeningCriteria // Default: PKDGRAV
+	Criteria OpeningCriteria // Default: PKDGRAV3
 	Theta float64 // Default: 0.7
 	Order ApproximationOrder // Default: Monopole
 
@@ -78,6 +171,7 @@ type TreeOptions struct {
 	NodeBuffer []Node
 	PBuffer [][3]float64
 	QBuffer [][3][3]float64
+	MultipoleBuffer []float64
 }
 
 // Reuse creates a Tree which reuses the internal buffers and configuration
@@ -88,11 +182,13 @@ func (t *Tree) Reuse() TreeOptions {
 		LeafSize: t.LeafSize,
 		Criteria: t.Criteria,
 		Theta: t.Theta,
+		Order: t.Order,
 		PointsBuffer: t.Points[:0],
 		IndexBuffer: t.Index[:0],
 		NodeBuffer: t.Nodes[:0],
 		PBuffer: t.P[:0],
 		QBuffer: t.Q[:0],
+		MultipoleBuffer: t.Multipoles[:0],
 	}
 }
 
@@ -101,6 +197,21 @@ func (t *Tree) Reuse() TreeOptions {
 // TreeOptions argument will be used. If fields in the TreeOptions argument
 // Are set to zero/nil, they will be replaced with the default values.
 func NewTree(x [][3]float64, opt ...TreeOptions) *Tree {
+	t, o := newEmptyTree(x, opt)
+	if len(x) == 0 { return t }
+
+	t.addNode(0, 0, len(x))
+	t.Root = &t.Nodes[0]
+	
+	t.allocateMoments(o)
+	computeMoments(t)
+
+	return t
+}
+
+// newEmptyTree sets the default options and creates a Tree with x's points
+// and indices but no nodes. It returns the options that were used.
+func newEmptyTree(x [][3]float64, opt []TreeOptions) (*Tree, TreeOptions) {
 	// Use default
 	if len(opt) == 0 {
 		opt = []TreeOptions{ {} }
@@ -114,6 +225,14 @@ func NewTree(x [][3]float64, opt ...TreeOptions) *Tree {
 	if opt[0].Order == 0 {
 		opt[0].Order = Monopole
 	}
+	if opt[0].Criteria == nil {
+		opt[0].Criteria = PKDGRAV3
+	}
+	
+	if opt[0].Order == Adaptive && !supportsAdaptive(opt[0].Criteria) {
+		panic(fmt.Sprintf("Adaptive order can't be used with %T criteria.",
+			opt[0].Criteria))
+	}
 	
 	t := &Tree{ Nodes: []Node{ }, LeafSize: opt[0].LeafSize,
 		Theta: opt[0].Theta, Criteria: opt[0].Criteria,
@@ -125,37 +244,99 @@ func NewTree(x [][3]float64, opt ...TreeOptions) *Tree {
 	t.Points = append(opt[0].PointsBuffer[:0], make([][3]float64, n)...)
 	t.Index = append(opt[0].IndexBuffer[:0], make([]int, n)...)
 	
-	nodeEstimate := int(math.Ceil(2*float64(len(x))/float64(t.LeafSize)))
-	t.Nodes = append(opt[0].NodeBuffer[:0], make([]Node, nodeEstimate)...)
+	t.Nodes = append(opt[0].NodeBuffer[:0],
+		make([]Node, nodeEstimate(n, t.LeafSize))...)
 	t.Nodes = t.Nodes[:0]
 	
 	copy(t.Points, x)
 	for i := range t.Index { t.Index[i] = i }
 
-	if len(x) == 0 { return t }
+	return t, opt[0]
+}
 
+// supportsAdaptive returns true if c can be used with Adaptive trees.
+func supportsAdaptive(c OpeningCriteria) bool {
+	switch c := c.(type) {
+	case PKDGRAV3Criteria, SalmonWarrenCriteria, BarnesHutCriteria,
+		BoxCriteria:
+		return true
+	case AdaptiveCriteria:
+		return c.SupportsAdaptive()
+	}
+	return false
+}
 
-	t.addNode(0, 0, len(x))
-	t.Root = &t.Nodes[0]
-	
-	// Compute higher order moments
+// nodeEstimate returns the number of nodes that NewTree allocates space for
+// ahead of time.
+func nodeEstimate(n, leafSize int) int {
+	return int(math.Ceil(2*float64(n)/float64(leafSize)))
+}
+
+// allocateMoments allocates the higher order moments needed by the tree's
+// order, reusing the buffers in opt.
+func (t *Tree) allocateMoments(opt TreeOptions) {
 	switch t.Order {
-	case Quadrupole:
-		t.P = append(opt[0].PBuffer, make([][3]float64, len(t.Nodes))...)
-		t.Q = append(opt[0].QBuffer, make([][3][3]float64, len(t.Nodes))...)
+	case Quadrupole, Adaptive:
+		t.P = append(opt.PBuffer[:0], make([][3]float64, len(t.Nodes))...)
+		t.Q = append(opt.QBuffer[:0], make([][3][3]float64, len(t.Nodes))...)
+	}
+	t.Multipoles = opt.MultipoleBuffer[:0]
+}
+
+// computeMoments computes the higher order moments of every node and, for
+// Adaptive trees, the opening radii of each order.
+func computeMoments(idx SpatialIndex) {
+	t := idx.Base()
+	computeMultipoles(idx)
+
+	switch t.Order {
+	case Quadrupole, Adaptive:
+		stride := multipoleStride(multipoleDegree(t.Order))
 		for i := range t.Nodes {
-			t.computeQuadrupoleMoment(i)
+			t.Q[i] = quadrupoleMoment(t.Multipoles[i*stride: (i+1)*stride])
+			q := &t.Q[i]
+			t.P[i] = [3]float64{ q[0][0], q[1][1], q[2][2] }
 		}
 	}
 
-	return t
+	if t.Order == Adaptive {
+		t.MonopoleROpen2 = append(t.MonopoleROpen2[:0],
+			make([]float64, len(t.Nodes))...)
+		for i := range t.Nodes {
+			node := &t.Nodes[i]
+			t.MonopoleROpen2[i] = node.ROpen2
+			node.ROpen2 = adaptiveROpen2(node.RMax2, node.ROpen2,
+				maxAdaptiveOrder)
+		}
+	}
+}
+
+// adaptiveROpen2 returns the squared opening radius of an order-n
+// approximation of a node with the given RMax2 and monopole opening radius.
+func adaptiveROpen2(rMax2, rOpen2 float64, n ApproximationOrder) float64 {
+	if n == Monopole || rOpen2 <= rMax2 { return rOpen2 }
+	return rMax2 * math.Pow(rOpen2/rMax2, 2/float64(n + 2))
+}
+
+// approximationOrder returns the order used to approximate node i1 of t1
+// when evaluating quantities at the points in node i2 of t2.
+func (t1 *Tree) approximationOrder(t2 *Tree, i1, i2 int) ApproximationOrder {
+	if t1.Order != Adaptive { return t1.Order }
+
+	node2, node1 := &t2.Nodes[i2], &t1.Nodes[i1]
+	d2 := boxDist2(&node1.Center, &node2.Span)
+	rMax2, rOpen2 := node1.RMax2, t1.MonopoleROpen2[i1]
+	for n := Monopole; n < maxAdaptiveOrder; n++ {
+		if d2 > adaptiveROpen2(rMax2, rOpen2, n) { return n }
+	}
+	return maxAdaptiveOrder
 }
 
 // addNode adds a node to a tree which corresponds to points in the range
 // [start: end] and a given depth.
 func (t *Tree) addNode(depth, start, end int) {
-	blankNode := Node{ [3]float64{}, 0, 0, 0, -1, -1, start, end }
 	span := pointSpan(t.Points[start: end])
+	blankNode := Node{ [3]float64{}, 0, 0, 0, -1, -1, start, end, span }
 	
 	i := len(t.Nodes)
 	t.Nodes = append(t.Nodes, blankNode)
@@ -183,20 +364,35 @@ func (t *Tree) rOpen2(i int, span [2][3]float64) float64 {
 	node.Center = centerOfMass(pts)
 	node.RMax, node.RMax2 = rMax2(node.Center, pts)
 	
-	switch t.Criteria {
-	case SalmonWarren:
-		return t.rOpen2SalmonWarren(i, span)
-	case BarnesHut:
-		return t.rOpen2BarnesHut(i, span)
-	case PKDGRAV3:
-		return t.rOpen2PKDGRAV3(i, span)
-	}
-	panic(fmt.Sprintf("Unknown tree criteria %d.", t.Criteria))
+	return t.criteria().ROpen2(t, i, span)
+}
+
+// criteria returns the tree's opening criteria. Trees which were constructed
+// manually use PKDGRAV3 by default.
+func (t *Tree) criteria() OpeningCriteria {
+	if t.Criteria == nil { return PKDGRAV3 }
+	return t.Criteria
 }
 
-// rOpen2PKDGRAV computes r_open^2 for the node, i, with span, span, using the
+// useSphereApproximation returns true if the distance between the centers of
+// node i1 of t1 and node i2 of t2 is larger than the sum of the
+// source node's opening radius and the target node's size. Used by the
+// built-in criteria.
+func useSphereApproximation(t1, t2 *Tree, i1, i2 int) bool {
+	node2, node1 := &t2.Nodes[i2], &t1.Nodes[i1]
+
+	x_i1, x_i2 := &node1.Center, &node2.Center
+	dx := x_i2[0] - x_i1[0]
+	dy := x_i2[1] - x_i1[1]
+	dz := x_i2[2] - x_i1[2]
+	dx2 := dx*dx + dy*dy + dz*dz
+	
+	return dx2 > node2.RMax2+node1.ROpen2
+}
+
+// ROpen2 computes r_open^2 for the node, i, with span, span, using the
 // Salmon-Warren monopole criteria.
-func (t *Tree) rOpen2SalmonWarren(i int, span [2][3]float64) float64 {
+func (SalmonWarrenCriteria) ROpen2(t *Tree, i int, span [2][3]float64) float64 {
 	node := &t.Nodes[i]
 	rMax := math.Sqrt(node.RMax2)
 	
@@ -213,9 +409,13 @@ func (t *Tree) rOpen2SalmonWarren(i int, span [2][3]float64) float64 {
 	return rOpen*rOpen
 }
 
-// rOpen2PKDGRAV computes r_open^2 for the node, i, with span, span, using the
+func (SalmonWarrenCriteria) UseApproximation(t1, t2 *Tree, i1, i2 int) bool {
+	return useSphereApproximation(t1, t2, i1, i2)
+}
+
+// ROpen2 computes r_open^2 for the node, i, with span, span, using the
 // classic Barnes-Hut criteria
-func (t *Tree) rOpen2BarnesHut(i int, span [2][3]float64) float64 {
+func (BarnesHutCriteria) ROpen2(t *Tree, i int, span [2][3]float64) float64 {
 	width := span[1][0] - span[0][0]
 	for k := 1; k < 3; k++ {
 		dx := span[1][k] - span[0][k]
@@ -225,13 +425,21 @@ func (t *Tree) rOpen2BarnesHut(i int, span [2][3]float64) float64 {
 	return width*width / (t.Theta*t.Theta)
 }
 
-// rOpen2PKDGRAV3 computes r_open^2 for the node, i, with span, span, using the
+func (BarnesHutCriteria) UseApproximation(t1, t2 *Tree, i1, i2 int) bool {
+	return useSphereApproximation(t1, t2, i1, i2)
+}
+
+// ROpen2 computes r_open^2 for the node, i, with span, span, using the
 // PKDGRAV3 criteria.
-func (t *Tree) rOpen2PKDGRAV3(i int, span [2][3]float64) float64 {
+func (PKDGRAV3Criteria) ROpen2(t *Tree, i int, span [2][3]float64) float64 {
 	node := &t.Nodes[i]
 	return 1.5*1.5 * node.RMax2 / (t.Theta*t.Theta)
 }
 
+func (PKDGRAV3Criteria) UseApproximation(t1, t2 *Tree, i1, i2 int) bool {
+	return useSphereApproximation(t1, t2, i1, i2)
+}
+
 // centerOfMass returns the center of mass for a collection of points, x.
 func centerOfMass(x [][3]float64) [3]float64 {
 	sum := &[3]float64{ }
@@ -297,6 +505,49 @@ func pointSpan(x [][3]float64) [2][3]float64 {
 	return [2][3]float64{ min, max }
 }
 
+// boxDist2 returns the squared minimum distance between the point x and the
+// box span. It's zero if x is inside the box.
+func boxDist2(x *[3]float64, span *[2][3]float64) float64 {
+	dx2 := 0.0
+	for k := 0; k < 3; k++ {
+		if x[k] < span[0][k] {
+			dx := span[0][k] - x[k]
+			dx2 += dx*dx
+		} else if x[k] > span[1][k] {
+			dx := x[k] - span[1][k]
+			dx2 += dx*dx
+		}
+	}
+	return dx2
+}
+
+// boxMaxDist2 returns the squared maximum distance between the point x and
+// any point in the box span.
+func boxMaxDist2(x *[3]float64, span *[2][3]float64) float64 {
+	dx2 := 0.0
+	for k := 0; k < 3; k++ {
+		dx := math.Max(x[k] - span[0][k], span[1][k] - x[k])
+		dx2 += dx*dx
+	}
+	return dx2
+}
+
+// boxBoxDist2 returns the squared minimum distance between any point in the
+// box a and any point in the box b. It's zero if the boxes overlap.
+func boxBoxDist2(a, b *[2][3]float64) float64 {
+	dx2 := 0.0
+	for k := 0; k < 3; k++ {
+		if a[1][k] < b[0][k] {
+			dx := b[0][k] - a[1][k]
+			dx2 += dx*dx
+		} else if b[1][k] < a[0][k] {
+			dx := a[0][k] - b[1][k]
+			dx2 += dx*dx
+		}
+	}
+	return dx2
+}
+
 // chooseNodeDimension returns the dimension that a node with the given span
 // should be split along.
 func chooseNodeDimension(span [2][3]float64) int {
@@ -366,18 +617,48 @@ func partition(x [][3]float64, idx []int, dim int, pivot float64) int {
 }
 
 
-func (t *Tree) computeQuadrupoleMoment(i int) {
-	// TODO: Write a funciton which computes P & Q for node i. As far as I know,
-	// there's no divide-and-conquer style agorithm for computing this from sub-
-	// nodes, so you can just compute it node-by-node.
-	panic("NYI")
+// quadrupoleMoment returns Q, the second moment of a node's points about its
+// center of mass, from its packed moments.
+func quadrupoleMoment(m []float64) [3][3]float64 {
+	q := [3][3]float64{ }
+	offset := multiIndexStart[2]
+	for k1 := 0; k1 < 3; k1++ {
+		for k2 := 0; k2 < 3; k2++ {
+			a := [3]int{ }
+			a[k1]++
+			a[k2]++
+			q[k1][k2] = m[multiIndexID[a[0]][a[1]][a[2]] - offset]
+		}
+	}
+	return q
 }
 
+// ShiftNodes updates the tree in response to new positions, x, without
+// reconstructing it. x must be in the same order as the points used to
+// construct the tree. The tree's topology is left unchanged, but the centers
+// of mass, radii, and higher order moments of every node are recomputed. This
+// is only a good idea when the points have moved by a small amount compared
+// to the sizes of the leaf nodes, otherwise nodes will become badly shaped.
 func (t *Tree) ShiftNodes(x [][3]float64) {
-	// TODO: write a function which "shifts" nodes /without reconstructing the tree/
-	// in response to position updates. This will mean updating the positions of all the
-	// particles stored in the tree, recomputing centers of mass, recomputing
-	// node "radii", and recomputing P and Q if the tree is using a quadrupole
-	// approximation.
-	panic("NYI")
+	shiftNodes(t.spatialIndex(), x)
+}
+
+// shiftNodes is the same as ShiftNodes, except that it works on any
+// SpatialIndex.
+func shiftNodes(idx SpatialIndex, x [][3]float64) {
+	t := idx.Base()
+	if len(x) != len(t.Points) {
+		panic(fmt.Sprintf("Tree has %d points, but len(x) = %d",
+			len(t.Points), len(x)))
+	}
+
+	for i := range t.Points { t.Points[i] = x[t.Index[i]] }
+
+	for i := range t.Nodes {
+		node := &t.Nodes[i]
+		node.Span = pointSpan(t.Points[node.Start: node.End])
+		node.ROpen2 = t.rOpen2(i, node.Span)
+	}
+
+	computeMoments(idx)
 }
@@ -0,0 +1,126 @@
+package gravitree
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// TreeStats contains diagnostics on the shape and memory usage of a tree.
+type TreeStats struct {
+	Nodes, Leaves, Points int
+
+	// MaxDepth and MeanDepth are computed over leaves. The root has depth 0.
+	MaxDepth int
+	MeanDepth float64
+
+	// LeafOccupancy[n] is the number of leaves which contain n points.
+	LeafOccupancy []int
+
+	// The aspect ratio of a node is the ratio between the longest and
+	// shortest sides of its bounding box. Nodes with a side of zero length
+	// (e.g. nodes with a single point) are counted in FlatNodes instead.
+	MedianAspectRatio, MaxAspectRatio float64
+	FlatNodes int
+
+	// NodeCapacity is the capacity of the Nodes buffer and NodeEstimate is
+	// the number of nodes that NewTree allocates for ahead of time.
+	// UnusedNodeCapacity is NodeCapacity - Nodes.
+	NodeCapacity, NodeEstimate, UnusedNodeCapacity int
+
+	// The number of bytes used by each of the tree's arrays. Buffers which
+	// aren't used by the tree's Order are empty.
+	PointsBytes, IndexBytes, NodesBytes, PBytes, QBytes, MultipoleBytes int
+	TotalBytes int
+}
+
+// Stats computes diagnostics on the shape and memory usage of t.
+func (t *Tree) Stats() *TreeStats {
+	s := &TreeStats{
+		Nodes: len(t.Nodes), Points: len(t.Points),
+		NodeCapacity: cap(t.Nodes),
+		UnusedNodeCapacity: cap(t.Nodes) - len(t.Nodes),
+
+		PointsBytes: len(t.Points) * int(unsafe.Sizeof([3]float64{ })),
+		IndexBytes: len(t.Index) * int(unsafe.Sizeof(int(0))),
+		NodesBytes: len(t.Nodes) * int(unsafe.Sizeof(Node{ })),
+		PBytes: len(t.P) * int(unsafe.Sizeof([3]float64{ })),
+		QBytes: len(t.Q) * int(unsafe.Sizeof([3][3]float64{ })),
+		MultipoleBytes: len(t.Multipoles) * int(unsafe.Sizeof(float64(0))),
+	}
+	if t.LeafSize > 0 {
+		s.NodeEstimate = nodeEstimate(len(t.Points), t.LeafSize)
+	}
+	s.TotalBytes = s.PointsBytes + s.IndexBytes + s.NodesBytes + s.PBytes +
+		s.QBytes + s.MultipoleBytes
+	if len(t.Nodes) == 0 { return s }
+
+	// Children always have larger indices than their parents.
+	depths := make([]int, len(t.Nodes))
+	idx := t.spatialIndex()
+	for i := range t.Nodes {
+		for c, n := 0, idx.NumChildren(i); c < n; c++ {
+			if j := idx.Child(i, c); j > i { depths[j] = depths[i] + 1 }
+		}
+	}
+
+	aspect := []float64{ }
+	for i := range t.Nodes {
+		node := &t.Nodes[i]
+
+		minWidth, maxWidth := math.Inf(+1), 0.0
+		for k := 0; k < 3; k++ {
+			width := node.Span[1][k] - node.Span[0][k]
+			minWidth = math.Min(minWidth, width)
+			maxWidth = math.Max(maxWidth, width)
+		}
+		if minWidth > 0 {
+			aspect = append(aspect, maxWidth/minWidth)
+		} else {
+			s.FlatNodes++
+		}
+
+		if node.Left != -1 { continue }
+
+		s.Leaves++
+		s.MeanDepth += float64(depths[i])
+		if depths[i] > s.MaxDepth { s.MaxDepth = depths[i] }
+
+		n := node.End - node.Start
+		for len(s.LeafOccupancy) <= n {
+			s.LeafOccupancy = append(s.LeafOccupancy, 0)
+		}
+		s.LeafOccupancy[n]++
+	}
+	s.MeanDepth /= float64(s.Leaves)
+
+	if len(aspect) > 0 {
+		sort.Float64s(aspect)
+		s.MedianAspectRatio = percentile(aspect, 0.5)
+		s.MaxAspectRatio = aspect[len(aspect) - 1]
+	}
+
+	return s
+}
+
+func (s *TreeStats) String() string {
+	b := &strings.Builder{ }
+	fmt.Fprintf(b, "Nodes: %d leaves: %d points: %d\n",
+		s.Nodes, s.Leaves, s.Points)
+	fmt.Fprintf(b, "Leaf depth: mean %.3g max %d\n", s.MeanDepth, s.MaxDepth)
+	fmt.Fprintf(b, "Leaf occupancy:")
+	for n := range s.LeafOccupancy {
+		fmt.Fprintf(b, " %d", s.LeafOccupancy[n])
+	}
+	fmt.Fprintf(b, "\n")
+	fmt.Fprintf(b, "Aspect ratio: median %.3g max %.3g (%d flat nodes)\n",
+		s.MedianAspectRatio, s.MaxAspectRatio, s.FlatNodes)
+	fmt.Fprintf(b, "Node buffer: capacity %d estimate %d unused %d\n",
+		s.NodeCapacity, s.NodeEstimate, s.UnusedNodeCapacity)
+	fmt.Fprintf(b, "Bytes: Points %d Index %d Nodes %d P %d Q %d " +
+		"Multipoles %d total %d\n", s.PointsBytes, s.IndexBytes,
+		s.NodesBytes, s.PBytes, s.QBytes, s.MultipoleBytes, s.TotalBytes)
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package gravitree
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestTreeStats(t *testing.T) {
+	rand.Seed(18)
+	x := normalPoints(4000)
+
+	for _, tree := range []*Tree{
+		NewTree(x, TreeOptions{ Order: Quadrupole }), &NewOctree(x).Tree,
+	} {
+		s := tree.Stats()
+
+		leaves, points := 0, 0
+		for n, count := range s.LeafOccupancy {
+			if n > tree.LeafSize && count > 0 {
+				t.Errorf("%d leaves have %d points.", count, n)
+			}
+			leaves += count
+			points += n*count
+		}
+		if leaves != s.Leaves || points != len(x) || s.Nodes != len(tree.Nodes) {
+			t.Errorf("Occupancy histogram %v doesn't match %d leaves, %d " +
+				"points.", s.LeafOccupancy, s.Leaves, len(x))
+		}
+
+		if s.MaxDepth == 0 || s.MeanDepth > float64(s.MaxDepth) ||
+			s.MeanDepth < 1 {
+			t.Errorf("Inconsistent depths: mean %g, max %d.",
+				s.MeanDepth, s.MaxDepth)
+		}
+		if s.MedianAspectRatio < 1 || s.MaxAspectRatio < s.MedianAspectRatio {
+			t.Errorf("Inconsistent aspect ratios: median %g, max %g.",
+				s.MedianAspectRatio, s.MaxAspectRatio)
+		}
+
+		if s.PointsBytes != 24*len(x) || s.QBytes != 72*len(tree.Q) ||
+			s.UnusedNodeCapacity != s.NodeCapacity - s.Nodes {
+			t.Errorf("Unexpected memory statistics:\n%s", s)
+		}
+		if !strings.Contains(s.String(), "Leaf occupancy:") {
+			t.Errorf("Unexpected String() output:\n%s", s)
+		}
+	}
+
+	// NewTree allocates 2*len(x)/LeafSize nodes and grows the buffer when
+	// this isn't enough.
+	s := NewTree(x, TreeOptions{ Order: Quadrupole }).Stats()
+	if s.QBytes != 72*s.Nodes {
+		t.Errorf("Expected %d bytes in Q, got %d.", 72*s.Nodes, s.QBytes)
+	}
+	if s.NodeEstimate != 2*len(x)/16 ||
+		s.NodeCapacity < s.Nodes || s.NodeCapacity < s.NodeEstimate {
+		t.Errorf("k-d tree used %d nodes with capacity %d and estimate %d.",
+			s.Nodes, s.NodeCapacity, s.NodeEstimate)
+	}
+
+	// ArrayTrees aren't hierarchical, but still have statistics.
+	s = NewArrayTree(x).Stats()
+	if s.Leaves != len(x) || s.MaxDepth != 0 {
+		t.Errorf("ArrayTree has %d leaves and max depth %d.",
+			s.Leaves, s.MaxDepth)
+	}
+}
@@ -2,6 +2,7 @@ package gravitree
 
 import (
 	"math"
+	"math/rand"
 	"testing"
 )
 
@@ -197,3 +198,239 @@ func TestROpen2(t *testing.T) {
 func almostEq(x, y, eps float64) bool {
 	return x + eps > y && x - eps < y
 }
+
+// directCriteria is an OpeningCriteria which never approximates nodes.
+type directCriteria struct{ }
+
+func (directCriteria) ROpen2(t *Tree, i int, span [2][3]float64) float64 {
+	return math.Inf(+1)
+}
+
+func (directCriteria) UseApproximation(t1, t2 *Tree, i1, i2 int) bool {
+	return false
+}
+
+func TestCustomCriteria(t *testing.T) {
+	x := [][3]float64{ }
+	for i := 0; i < 200; i++ {
+		x = append(x, [3]float64{
+			math.Cos(float64(i)), math.Sin(float64(3*i)), float64(i)/200 })
+	}
+
+	tree := NewTree(x, TreeOptions{ Criteria: directCriteria{ }, LeafSize: 4 })
+	for i := range tree.Nodes {
+		if !math.IsInf(tree.Nodes[i].ROpen2, +1) {
+			t.Fatalf("Node %d has ROpen2 = %g, not +Inf.",
+				i, tree.Nodes[i].ROpen2)
+		}
+	}
+
+	phi, phiBrute := make([]float64, len(x)), make([]float64, len(x))
+	tree.Evaluate(0.01, Potential(phi))
+	BruteForcePotential(0.01, x, phiBrute)
+
+	for i := range phi {
+		if !almostEq(phi[i], phiBrute[i], 1e-9) {
+			t.Errorf("Expected phi[%d] = %g, got %g.", i, phiBrute[i], phi[i])
+		}
+	}
+}
+
+func TestBoxDist2(t *testing.T) {
+	span := [2][3]float64{ {0, 0, 0}, {1, 2, 3} }
+	tests := []struct {
+		x [3]float64
+		dist2, maxDist2 float64
+	}{
+		{[3]float64{0.5, 1, 1}, 0, 0.25 + 1 + 4},
+		{[3]float64{-1, 1, 1}, 1, 4 + 1 + 4},
+		{[3]float64{2, 3, 4}, 3, 4 + 9 + 16},
+		{[3]float64{0, 0, 0}, 0, 1 + 4 + 9},
+		{[3]float64{0.5, -2, 5}, 4 + 4, 0.25 + 16 + 25},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		dist2 := boxDist2(&test.x, &span)
+		maxDist2 := boxMaxDist2(&test.x, &span)
+		if !almostEq(dist2, test.dist2, 1e-9) {
+			t.Errorf("%d) Expected boxDist2 = %g, got %g.",
+				i, test.dist2, dist2)
+		}
+		if !almostEq(maxDist2, test.maxDist2, 1e-9) {
+			t.Errorf("%d) Expected boxMaxDist2 = %g, got %g.",
+				i, test.maxDist2, maxDist2)
+		}
+
+		box := [2][3]float64{ test.x, test.x }
+		if d2 := boxBoxDist2(&box, &span); !almostEq(d2, dist2, 1e-9) {
+			t.Errorf("%d) Expected boxBoxDist2 = %g, got %g.", i, dist2, d2)
+		}
+	}
+
+	other := [2][3]float64{ {2, 4, -2}, {3, 5, -1} }
+	if d2 := boxBoxDist2(&span, &other); !almostEq(d2, 1 + 4 + 1, 1e-9) {
+		t.Errorf("Expected boxBoxDist2 = 6, got %g.", d2)
+	}
+}
+
+func TestQuadrupole(t *testing.T) {
+	rand.Seed(12)
+	x := normalPoints(3000)
+	eps := 0.01
+
+	phiErr := map[ApproximationOrder]ErrorPercentiles{ }
+	accErr := map[ApproximationOrder]ErrorPercentiles{ }
+	for _, order := range []ApproximationOrder{ Monopole, Quadrupole } {
+		tree := NewTree(x, TreeOptions{ Order: order, Theta: 0.5 })
+		phi := make([]float64, len(x))
+		tree.Evaluate(eps, Potential(phi))
+		acc := make([][3]float64, len(x))
+		tree.Evaluate(eps, Acceleration(acc))
+
+		phiErr[order] = tree.AuditPotential(eps, phi, 300, 0)
+		accErr[order] = tree.AuditAcceleration(eps, acc, 300, 0)
+	}
+
+	if phiErr[Quadrupole].P99 > phiErr[Monopole].P99/3 {
+		t.Errorf("Quadrupole potential errors %s aren't much smaller than " +
+			"monopole errors %s.", phiErr[Quadrupole], phiErr[Monopole])
+	}
+	if accErr[Quadrupole].P99 > accErr[Monopole].P99/3 {
+		t.Errorf("Quadrupole acceleration errors %s aren't much smaller " +
+			"than monopole errors %s.", accErr[Quadrupole], accErr[Monopole])
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	rand.Seed(13)
+	x := normalPoints(3000)
+	eps := 0.01
+
+	calls := map[ApproximationOrder]int{ }
+	accErr := map[ApproximationOrder]ErrorPercentiles{ }
+	for _, order := range []ApproximationOrder{ Monopole, Adaptive } {
+		tree := NewTree(x, TreeOptions{ Order: order })
+		acc := make([][3]float64, len(x))
+		cs := NewCallStructure(tree, tree, Acceleration(acc))
+		tree.Evaluate(eps, cs)
+
+		stats := cs.Stats()
+		calls[order] = stats.ApproximateCalls + stats.OneSidedLeafCalls
+		accErr[order] = tree.AuditAcceleration(eps, acc, 300, 0)
+
+		if order != Adaptive { continue }
+
+		// Each approximation must use the lowest order whose opening
+		// radius is closer than the target. The highest order is also used
+		// when the criteria accepts a node that's closer than its radius.
+		nQuad := 0
+		for i2 := range cs.ApproximateCalls {
+			for _, c := range cs.ApproximateCalls[i2] {
+				n := tree.approximationOrder(tree, c.I1, c.I2)
+				d2 := boxDist2(&tree.Nodes[c.I1].Center, &tree.Nodes[c.I2].Span)
+				rMax2 := tree.Nodes[c.I1].RMax2
+				rOpen2 := tree.MonopoleROpen2[c.I1]
+				if (n < maxAdaptiveOrder &&
+					d2 <= adaptiveROpen2(rMax2, rOpen2, n)) ||
+					(n > Monopole && d2 > adaptiveROpen2(rMax2, rOpen2, n-1)) {
+					t.Fatalf("Node %d used order %d at a distance of %g.",
+						c.I1, n, math.Sqrt(d2))
+				}
+				if n == Quadrupole { nQuad++ }
+			}
+		}
+		if nQuad == 0 {
+			t.Errorf("No quadrupole approximations were used.")
+		}
+	}
+
+	if calls[Adaptive] >= calls[Monopole] {
+		t.Errorf("Adaptive made %d calls, but Monopole only made %d.",
+			calls[Adaptive], calls[Monopole])
+	}
+	if accErr[Adaptive].P99 > 2*accErr[Monopole].P99 {
+		t.Errorf("Adaptive errors %s are much larger than monopole errors %s.",
+			accErr[Adaptive], accErr[Monopole])
+	}
+}
+
+// adaptiveCriteria is BoxCriteria with an Adaptive opt-in.
+type adaptiveCriteria struct{ BoxCriteria }
+
+func (adaptiveCriteria) SupportsAdaptive() bool { return true }
+
+func TestAdaptiveCriteria(t *testing.T) {
+	tests := []struct{
+		c OpeningCriteria
+		ok bool
+	}{
+		{ PKDGRAV3, true }, { SalmonWarren, true }, { BarnesHut, true },
+		{ BoxCriteria{ }, true }, { adaptiveCriteria{ }, true },
+		{ SalmonWarrenAbsolute{ MaxError: 10 }, false },
+		{ NewRelativeCriteria(0.01, nil), false },
+		{ directCriteria{ }, false },
+	}
+
+	x := randomPoints(100)
+	for i := range tests {
+		if ok := supportsAdaptive(tests[i].c); ok != tests[i].ok {
+			t.Errorf("%d) supportsAdaptive(%T) = %v, expected %v.",
+				i, tests[i].c, ok, tests[i].ok)
+		}
+
+		panicked := func() (panicked bool) {
+			defer func() { panicked = recover() != nil }()
+			NewTree(x, TreeOptions{ Order: Adaptive, Criteria: tests[i].c })
+			return false
+		}()
+		if panicked == tests[i].ok {
+			t.Errorf("%d) NewTree with Adaptive %T criteria panicked = %v.",
+				i, tests[i].c, panicked)
+		}
+	}
+}
+
+func TestMultipoles(t *testing.T) {
+	rand.Seed(14)
+	x := normalPoints(2000)
+	tree := NewTree(x, TreeOptions{ Order: Hexadecapole, Theta: 0.5 })
+
+	// Moments shifted up from the leaves should match direct sums.
+	stride := multipoleStride(maxMultipoleDegree)
+	for _, i := range []int{ 0, 1, len(tree.Nodes)/2, len(tree.Nodes) - 1 } {
+		node := &tree.Nodes[i]
+		direct := make([]float64, stride)
+		for j := node.Start; j < node.End; j++ {
+			addShiftedMoments(direct, nil, 1, &node.Center, &tree.Points[j],
+				maxMultipoleDegree)
+		}
+
+		m := tree.Multipoles[i*stride: (i+1)*stride]
+		for j := range m {
+			if !almostEq(m[j], direct[j], 1e-8*(1 + math.Abs(direct[j]))) {
+				a := multiIndices[j + multiIndexStart[2]]
+				t.Errorf("Node %d has M_%v = %g, expected %g.",
+					i, a, m[j], direct[j])
+			}
+		}
+	}
+
+	// Each order should be more accurate than the one before it.
+	prevPhi, prevAcc := math.Inf(+1), math.Inf(+1)
+	for order := Monopole; order <= Hexadecapole; order++ {
+		tree := NewTree(x, TreeOptions{ Order: order, Theta: 0.5 })
+		phi := make([]float64, len(x))
+		tree.Evaluate(0.01, Potential(phi))
+		acc := make([][3]float64, len(x))
+		tree.Evaluate(0.01, Acceleration(acc))
+
+		phiErr := tree.AuditPotential(0.01, phi, 300, 0)
+		accErr := tree.AuditAcceleration(0.01, acc, 300, 0)
+		if phiErr.Median > prevPhi/1.5 || accErr.Median > prevAcc/1.5 {
+			t.Errorf("Order %d gave potential errors %s and acceleration " +
+				"errors %s.", order, phiErr, accErr)
+		}
+		prevPhi, prevAcc = phiErr.Median, accErr.Median
+	}
+}
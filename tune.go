@@ -0,0 +1,162 @@
+package gravitree
+
+import (
+	"time"
+)
+
+// TuneOptions configures Tune. Fields which are set to zero/nil are replaced
+// with their default values.
+type TuneOptions struct {
+	// TargetError is the maximum allowed 99th percentile relative error.
+	// Default: 1e-3
+	TargetError float64
+	// Acceleration tunes against acceleration errors instead of potential
+	// errors. Default: false
+	Acceleration bool
+	// Eps is the force softening scale used during tuning. Default: 0
+	Eps float64
+	// Budget is the approximate amount of time to spend tuning. At least one
+	// configuration is always tested. Default: 10 seconds
+	Budget time.Duration
+	// Samples is the number of brute-force spot checks used to measure the
+	// error of each configuration. Default: 200
+	Samples int
+	// Seed is the random seed used to choose spot check points.
+	Seed int64
+
+	// The candidate values that are explored. Thetas are tested from the
+	// largest (fastest) to the smallest, so they should be ordered that way.
+	// Defaults: {1.0, 0.85, 0.7, 0.6, 0.5, 0.4, 0.3, 0.2}, {8, 16, 32},
+	// {PKDGRAV3, SalmonWarren, BarnesHut}, {Monopole, Quadrupole, Adaptive}
+	// Adaptive is skipped for criteria which don't support it (see
+	// Adaptive).
+	Thetas []float64
+	LeafSizes []int
+	Criteria []OpeningCriteria
+	Orders []ApproximationOrder
+}
+
+// TuneResult is the outcome of Tune.
+type TuneResult struct {
+	Options TreeOptions // The fastest configuration found.
+	Time time.Duration // Time taken to build the tree and evaluate it.
+	Error ErrorPercentiles // Spot-check errors of this configuration.
+	// OK is true if Options meets the target error. If no configuration
+	// does, Options is the most accurate configuration that was tested.
+	OK bool
+	Tested int // The number of configurations that were tested.
+}
+
+// Tune searches the TreeOptions in opt for the fastest configuration that
+// reaches the target error for the points in x. Each configuration is timed
+// by building a tree and evaluating it, and its error is measured with brute
+// force spot checks (see Tree.AuditPotential). For each combination of
+// LeafSize, Criteria, and Order, Thetas are tested from largest to smallest
+// until the target is met. The search stops early once the time budget has
+// been used.
+func Tune(x [][3]float64, opt TuneOptions) TuneResult {
+	setTuneDefaults(&opt)
+
+	start := time.Now()
+	res := TuneResult{ }
+
+	configs:
+	for _, order := range opt.Orders {
+		for _, criteria := range opt.Criteria {
+			if order == Adaptive && !supportsAdaptive(criteria) { continue }
+			for _, leafSize := range opt.LeafSizes {
+				for _, theta := range opt.Thetas {
+					if res.Tested > 0 && time.Since(start) > opt.Budget {
+						break configs
+					}
+
+					topt := TreeOptions{ LeafSize: leafSize,
+						Criteria: criteria, Theta: theta, Order: order }
+					dt, err := tuneTest(x, topt, &opt)
+					res.Tested++
+
+					ok := err.P99 <= opt.TargetError
+					if tuneImproves(&res, ok, dt, err) {
+						res.Options, res.Time, res.Error = topt, dt, err
+						res.OK = ok
+					}
+
+					// Smaller thetas are slower, so stop once the target
+					// is reached.
+					if ok { break }
+				}
+			}
+		}
+	}
+
+	return res
+}
+
+// tuneImproves returns true if a configuration with the given time and
+// errors is better than the current result. Configurations which meet the
+// target are compared by speed, and ones that don't are compared by accuracy.
+func tuneImproves(
+	res *TuneResult, ok bool, dt time.Duration, err ErrorPercentiles,
+) bool {
+	switch {
+	case res.Tested == 1:
+		return true
+	case ok && res.OK:
+		return dt < res.Time
+	case ok != res.OK:
+		return ok
+	default:
+		return err.P99 < res.Error.P99
+	}
+}
+
+func setTuneDefaults(opt *TuneOptions) {
+	if opt.TargetError == 0 { opt.TargetError = 1e-3 }
+	if opt.Budget == 0 { opt.Budget = 10*time.Second }
+	if opt.Samples == 0 { opt.Samples = 200 }
+	if opt.Thetas == nil {
+		opt.Thetas = []float64{ 1.0, 0.85, 0.7, 0.6, 0.5, 0.4, 0.3, 0.2 }
+	}
+	if opt.LeafSizes == nil { opt.LeafSizes = []int{ 8, 16, 32 } }
+	if opt.Criteria == nil {
+		opt.Criteria = []OpeningCriteria{ PKDGRAV3, SalmonWarren, BarnesHut }
+	}
+	if opt.Orders == nil {
+		opt.Orders = []ApproximationOrder{ Monopole, Quadrupole, Adaptive }
+	}
+}
+
+// tuneTest times a single configuration and measures its errors. The
+// fastest of three runs is used as the time.
+func tuneTest(
+	x [][3]float64, topt TreeOptions, opt *TuneOptions,
+) (time.Duration, ErrorPercentiles) {
+	var phi Potential
+	var acc Acceleration
+	var tree *Tree
+	best := time.Duration(0)
+
+	for i := 0; i < 3; i++ {
+		if opt.Acceleration {
+			acc = make([][3]float64, len(x))
+		} else {
+			phi = make([]float64, len(x))
+		}
+
+		t0 := time.Now()
+		tree = NewTree(x, topt)
+		if opt.Acceleration {
+			tree.Evaluate(opt.Eps, acc)
+		} else {
+			tree.Evaluate(opt.Eps, phi)
+		}
+		dt := time.Since(t0)
+
+		if i == 0 || dt < best { best = dt }
+	}
+
+	if opt.Acceleration {
+		return best, tree.AuditAcceleration(opt.Eps, acc, opt.Samples, opt.Seed)
+	}
+	return best, tree.AuditPotential(opt.Eps, phi, opt.Samples, opt.Seed)
+}
@@ -0,0 +1,51 @@
+package gravitree
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestTune(t *testing.T) {
+	rand.Seed(8)
+	x := randomPoints(2000)
+
+	opt := TuneOptions{
+		TargetError: 1e-3, Budget: time.Minute,
+		Thetas: []float64{ 1.0, 0.7, 0.5, 0.3 }, LeafSizes: []int{ 16 },
+	}
+	res := Tune(x, opt)
+
+	if !res.OK {
+		t.Fatalf("Tune couldn't reach an error of %g.", opt.TargetError)
+	} else if res.Tested < 3 {
+		t.Errorf("Expected at least 3 configurations, got %d.", res.Tested)
+	}
+
+	// The returned options should actually reach the target.
+	tree := NewTree(x, res.Options)
+	phi := make([]float64, len(x))
+	tree.Evaluate(0, Potential(phi))
+	err := tree.AuditPotential(0, phi, 200, 0)
+	if err.P99 > opt.TargetError {
+		t.Errorf("Tuned options %+v have errors %s, above the target %g.",
+			res.Options, err, opt.TargetError)
+	}
+
+	// A tiny budget still tests one configuration.
+	res = Tune(x, TuneOptions{ Budget: time.Nanosecond, Acceleration: true })
+	if res.Tested != 1 {
+		t.Errorf("Expected 1 configuration with a tiny budget, got %d.",
+			res.Tested)
+	}
+
+	// Criteria which don't support Adaptive skip it.
+	res = Tune(x, TuneOptions{ Budget: time.Minute,
+		Thetas: []float64{ 0.7 }, LeafSizes: []int{ 16 },
+		Criteria: []OpeningCriteria{ SalmonWarrenAbsolute{ MaxError: 1 } } })
+	if res.Tested != 2 || res.Options.Order == Adaptive {
+		t.Errorf("Expected Monopole and Quadrupole to be tested, but %d " +
+			"configurations were tested and %d was chosen.",
+			res.Tested, res.Options.Order)
+	}
+}
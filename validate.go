@@ -0,0 +1,175 @@
+package gravitree
+
+import (
+	"fmt"
+	"math"
+)
+
+// validateTol is the relative tolerance used when Validate compares
+// floating point values against recomputed ones.
+const validateTol = 1e-9
+
+// Validate checks the invariants of a tree made by NewTree or NewOctree and
+// returns an error describing the first one which fails, or nil. It checks
+// that:
+//
+//   - Index is a permutation of the input indices.
+//   - The root contains every point, and the children of each node tile its
+//     [Start, End) range in order.
+//   - Every point is inside its node's Span and within RMax of its Center.
+//   - Leaves have at most LeafSize points, unless all their points are at
+//     the same position.
+//   - ROpen2 matches the value given by the tree's Criteria and Order.
+//   - The moment arrays needed by the tree's Order have one entry per node.
+//
+// This is useful in tests and after rebuilding trees from reused buffers or
+// loading them from disk.
+func (t *Tree) Validate() error {
+	n := len(t.Points)
+	if len(t.Index) != n {
+		return fmt.Errorf("len(Points) = %d, but len(Index) = %d",
+			n, len(t.Index))
+	}
+	seen := make([]bool, n)
+	for i, idx := range t.Index {
+		if idx < 0 || idx >= n {
+			return fmt.Errorf("Index[%d] = %d is outside [0, %d)", i, idx, n)
+		} else if seen[idx] {
+			return fmt.Errorf("Index[%d] = %d appears more than once", i, idx)
+		}
+		seen[idx] = true
+	}
+
+	if len(t.Nodes) == 0 {
+		if n > 0 { return fmt.Errorf("tree has %d points but no nodes", n) }
+		return nil
+	}
+	if root := &t.Nodes[0]; root.Start != 0 || root.End != n {
+		return fmt.Errorf("root node covers [%d, %d), not [0, %d)",
+			root.Start, root.End, n)
+	}
+
+	if err := t.validateMoments(); err != nil { return err }
+
+	idx := t.spatialIndex()
+	parents := make([]int, len(t.Nodes))
+	for i := range t.Nodes {
+		if err := t.validateNode(idx, i, parents); err != nil { return err }
+	}
+	for i := 1; i < len(t.Nodes); i++ {
+		if parents[i] != 1 {
+			return fmt.Errorf("node %d is the child of %d nodes, not 1",
+				i, parents[i])
+		}
+	}
+
+	return nil
+}
+
+// validateNode checks the invariants of node i and counts the parents of its
+// children.
+func (t *Tree) validateNode(idx SpatialIndex, i int, parents []int) error {
+	node := &t.Nodes[i]
+	if node.Start < 0 || node.End > len(t.Points) || node.Start >= node.End {
+		return fmt.Errorf("node %d has an invalid range, [%d, %d)",
+			i, node.Start, node.End)
+	}
+
+	// Children tile the node's range.
+	nc := idx.NumChildren(i)
+	start := node.Start
+	for c := 0; c < nc; c++ {
+		j := idx.Child(i, c)
+		if j <= i || j >= len(t.Nodes) {
+			return fmt.Errorf("child %d of node %d has index %d, which " +
+				"isn't in (%d, %d)", c, i, j, i, len(t.Nodes))
+		}
+		parents[j]++
+		child := &t.Nodes[j]
+		if child.Start != start {
+			return fmt.Errorf("child %d (node %d) of node %d starts at %d, " +
+				"but the previous range ended at %d",
+				c, j, i, child.Start, start)
+		}
+		start = child.End
+	}
+	if nc > 0 && start != node.End {
+		return fmt.Errorf("children of node %d end at %d, not %d",
+			i, start, node.End)
+	}
+
+	// Points are inside the node.
+	rMax2 := node.RMax2 * (1 + validateTol) + validateTol*validateTol
+	if !almostEqual(node.RMax*node.RMax, node.RMax2) {
+		return fmt.Errorf("node %d has RMax = %g but RMax2 = %g",
+			i, node.RMax, node.RMax2)
+	}
+	for j := node.Start; j < node.End; j++ {
+		x := &t.Points[j]
+		if r2 := calcR2(&node.Center, x); r2 > rMax2 {
+			return fmt.Errorf("point %d (input index %d) is %g from the " +
+				"center of node %d, but RMax = %g",
+				j, t.Index[j], math.Sqrt(r2), i, node.RMax)
+		}
+		for k := 0; k < 3; k++ {
+			if x[k] < node.Span[0][k] || x[k] > node.Span[1][k] {
+				return fmt.Errorf("point %d (input index %d) is outside " +
+					"the span of node %d, %v", j, t.Index[j], i, node.Span)
+			}
+		}
+	}
+
+	if nc == 0 && node.End - node.Start > t.LeafSize &&
+		node.Span[0] != node.Span[1] {
+		return fmt.Errorf("leaf %d has %d points, but LeafSize = %d",
+			i, node.End - node.Start, t.LeafSize)
+	}
+
+	// Opening radii match the criteria.
+	rOpen2 := t.criteria().ROpen2(t, i, node.Span)
+	if t.Order == Adaptive {
+		if !almostEqual(t.MonopoleROpen2[i], rOpen2) {
+			return fmt.Errorf("node %d has MonopoleROpen2 = %g, but the " +
+				"criteria gives %g", i, t.MonopoleROpen2[i], rOpen2)
+		}
+		rOpen2 = adaptiveROpen2(node.RMax2, rOpen2, maxAdaptiveOrder)
+	}
+	if !almostEqual(node.ROpen2, rOpen2) {
+		return fmt.Errorf("node %d has ROpen2 = %g, but the criteria " +
+			"gives %g", i, node.ROpen2, rOpen2)
+	}
+
+	return nil
+}
+
+// validateMoments checks that the moment arrays used by the tree's order have
+// the right lengths.
+func (t *Tree) validateMoments() error {
+	nNodes := len(t.Nodes)
+	switch t.Order {
+	case Quadrupole, Adaptive:
+		if len(t.P) != nNodes || len(t.Q) != nNodes {
+			return fmt.Errorf("tree has %d nodes, but len(P) = %d and " +
+				"len(Q) = %d", nNodes, len(t.P), len(t.Q))
+		}
+	}
+	if t.Order == Adaptive && len(t.MonopoleROpen2) != nNodes {
+		return fmt.Errorf("tree has %d nodes, but len(MonopoleROpen2) = %d",
+			nNodes, len(t.MonopoleROpen2))
+	}
+
+	stride := multipoleStride(multipoleDegree(t.Order))
+	if len(t.Multipoles) != stride*nNodes {
+		return fmt.Errorf("tree has %d nodes with %d moments each, but " +
+			"len(Multipoles) = %d", nNodes, stride, len(t.Multipoles))
+	}
+
+	return nil
+}
+
+// almostEqual returns true if x and y are equal to within validateTol. This
+// includes the case where both are the same infinity.
+func almostEqual(x, y float64) bool {
+	if x == y { return true }
+	return math.Abs(x - y) <= validateTol * math.Max(math.Abs(x), math.Abs(y))
+}
@@ -0,0 +1,54 @@
+package gravitree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	rand.Seed(19)
+	x := normalPoints(3000)
+
+	trees := []*Tree{
+		NewTree(x), NewTree([][3]float64{ }),
+		NewTree(x, TreeOptions{ Order: Adaptive, Criteria: SalmonWarren }),
+		NewTree(x, TreeOptions{ Order: Hexadecapole, Criteria: BoxCriteria{ } }),
+		&NewOctree(x, TreeOptions{ Order: Quadrupole }).Tree,
+	}
+
+	// Rebuilds from reused buffers and shifted trees are also valid.
+	reused := NewTree(x, TreeOptions{ Order: Quadrupole })
+	trees = append(trees, NewTree(normalPoints(1000), reused.Reuse()))
+	shifted := NewTree(x)
+	for i := range x {
+		for k := 0; k < 3; k++ { x[i][k] += 1e-3*rand.NormFloat64() }
+	}
+	shifted.ShiftNodes(x)
+	trees = append(trees, shifted)
+
+	for i, tree := range trees {
+		if err := tree.Validate(); err != nil {
+			t.Errorf("%d) Valid tree failed validation: %v", i, err)
+		}
+	}
+
+	corruptions := []func(tree *Tree){
+		func(tree *Tree) { tree.Index[3] = tree.Index[4] },
+		func(tree *Tree) { tree.Points[10][0] += 100 },
+		func(tree *Tree) { tree.Nodes[tree.Nodes[0].Right].Start++ },
+		func(tree *Tree) { tree.Nodes[0].Left = tree.Nodes[0].Right },
+		func(tree *Tree) { tree.Nodes[5].ROpen2 *= 2 },
+		func(tree *Tree) { tree.Nodes[7].Center[1] += 10 },
+		func(tree *Tree) { tree.LeafSize = 2 },
+		func(tree *Tree) { tree.Q = tree.Q[:1] },
+		func(tree *Tree) { tree.Nodes[0].End-- },
+	}
+
+	for i, corrupt := range corruptions {
+		tree := NewTree(x, TreeOptions{ Order: Quadrupole })
+		corrupt(tree)
+		if err := tree.Validate(); err == nil {
+			t.Errorf("%d) Corrupted tree passed validation.", i)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package gravitree
+
+import (
+	"fmt"
+)
+
+// VisitAction tells Walk what to do with a node.
+type VisitAction int
+
+const (
+	// Prune skips the node and all of its points.
+	Prune VisitAction = iota
+	// Accept passes the whole node to Visitor.Accept without looking at its
+	// children.
+	Accept
+	// Descend visits the node's children. Leaves are passed to
+	// Visitor.Leaf instead, so that their points can be checked one by one.
+	Descend
+)
+
+// Visitor is a custom tree query which is run by Walk. At each node, Visit
+// decides whether to prune the node, accept it whole, or descend into it.
+// Node i's geometry is in t.Nodes[i] (Center, RMax, Span, etc.) and its
+// points are t.Points[t.Nodes[i].Start: t.Nodes[i].End], with original
+// indices in the same range of t.Index. Visitors should read these directly
+// rather than copying them.
+//
+// For example, a visitor which sums the mass in a cone would prune nodes whose
+// bounding spheres are outside the cone, accept nodes whose bounding boxes are
+// inside it, and check the points of the remaining leaves.
+type Visitor interface {
+	Visit(t *Tree, i int) VisitAction
+	Accept(t *Tree, i int) // Called on nodes that Visit accepted.
+	Leaf(t *Tree, i int) // Called on leaves that Visit descended into.
+}
+
+// Walk runs a depth-first traversal of t with v, starting from the root.
+// Children are visited in order, so for a k-d tree the points of accepted
+// nodes and leaves are visited in the order they're stored in t.Points.
+func (t *Tree) Walk(v Visitor) {
+	walk(t.spatialIndex(), v)
+}
+
+// walk is the same as Walk, except that it walks any SpatialIndex.
+func walk(idx SpatialIndex, v Visitor) {
+	t := idx.Base()
+	if len(t.Nodes) == 0 { return }
+	walkVisitor(idx, t, 0, v)
+}
+
+func walkVisitor(idx SpatialIndex, t *Tree, i int, v Visitor) {
+	switch action := v.Visit(t, i); action {
+	case Prune:
+	case Accept:
+		v.Accept(t, i)
+	case Descend:
+		nc := idx.NumChildren(i)
+		if nc == 0 {
+			v.Leaf(t, i)
+			return
+		}
+		for c := 0; c < nc; c++ {
+			walkVisitor(idx, t, idx.Child(i, c), v)
+		}
+	default:
+		panic(fmt.Sprintf("Unrecognized VisitAction, %d", action))
+	}
+}
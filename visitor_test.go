@@ -0,0 +1,110 @@
+package gravitree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// shellVisitor finds the nodes whose bounding spheres intersect a shell
+// around the origin and the points inside the shell.
+type shellVisitor struct {
+	rMin, rMax float64
+	nodes, points []int
+}
+
+func (v *shellVisitor) Visit(t *Tree, i int) VisitAction {
+	node := &t.Nodes[i]
+	r := math.Sqrt(node.Center[0]*node.Center[0] +
+		node.Center[1]*node.Center[1] + node.Center[2]*node.Center[2])
+	if r + node.RMax < v.rMin || r - node.RMax > v.rMax { return Prune }
+	v.nodes = append(v.nodes, i)
+	return Descend
+}
+
+func (v *shellVisitor) Accept(t *Tree, i int) {
+	panic("shellVisitor never accepts nodes")
+}
+
+func (v *shellVisitor) Leaf(t *Tree, i int) {
+	node := &t.Nodes[i]
+	for j := node.Start; j < node.End; j++ {
+		x := &t.Points[j]
+		r := math.Sqrt(x[0]*x[0] + x[1]*x[1] + x[2]*x[2])
+		if r >= v.rMin && r < v.rMax { v.points = append(v.points, t.Index[j]) }
+	}
+}
+
+// coneVisitor sums the mass in a cone with its tip at the origin, pointing
+// along the z axis.
+type coneVisitor struct {
+	cosAngle float64
+	mass, accepted int
+}
+
+func (v *coneVisitor) inCone(x *[3]float64) bool {
+	r := math.Sqrt(x[0]*x[0] + x[1]*x[1] + x[2]*x[2])
+	return x[2] > v.cosAngle*r
+}
+
+func (v *coneVisitor) Visit(t *Tree, i int) VisitAction {
+	node := &t.Nodes[i]
+	// The cone is convex, so boxes are inside it if all corners are.
+	inside := true
+	for corner := 0; corner < 8 && inside; corner++ {
+		x := [3]float64{ }
+		for k := 0; k < 3; k++ { x[k] = node.Span[(corner >> k) & 1][k] }
+		inside = v.inCone(&x)
+	}
+	if inside { return Accept }
+
+	// Prune nodes whose bounding spheres are entirely outside the cone.
+	c := &node.Center
+	r := math.Sqrt(c[0]*c[0] + c[1]*c[1] + c[2]*c[2])
+	if r > node.RMax {
+		angle := math.Acos(c[2] / r) - math.Asin(node.RMax / r)
+		if angle > math.Acos(v.cosAngle) { return Prune }
+	}
+	return Descend
+}
+
+func (v *coneVisitor) Accept(t *Tree, i int) {
+	v.mass += t.Nodes[i].End - t.Nodes[i].Start
+	v.accepted++
+}
+
+func (v *coneVisitor) Leaf(t *Tree, i int) {
+	for j := t.Nodes[i].Start; j < t.Nodes[i].End; j++ {
+		if v.inCone(&t.Points[j]) { v.mass++ }
+	}
+}
+
+func TestWalk(t *testing.T) {
+	rand.Seed(24)
+	x := normalPoints(5000)
+	tree, ot := NewTree(x), NewOctree(x)
+
+	for _, walk := range []func(v Visitor){ tree.Walk, ot.Walk } {
+		shell := &shellVisitor{ rMin: 0.8, rMax: 1.2 }
+		walk(shell)
+		checkSearch(t, "shellVisitor", 0, x, shell.points,
+			func(x *[3]float64) bool {
+				r := math.Sqrt(x[0]*x[0] + x[1]*x[1] + x[2]*x[2])
+				return r >= 0.8 && r < 1.2
+			})
+		if shell.nodes[0] != 0 || len(shell.nodes) == len(tree.Nodes) {
+			t.Errorf("Shell visited %d nodes.", len(shell.nodes))
+		}
+
+		cone := &coneVisitor{ cosAngle: math.Cos(0.4) }
+		walk(cone)
+		mass := 0
+		for i := range x {
+			if cone.inCone(&x[i]) { mass++ }
+		}
+		if cone.mass != mass || cone.accepted == 0 {
+			t.Errorf("Cone has mass %d from %d accepted nodes, expected %d.",
+				cone.mass, cone.accepted, mass)
+		}
+	}
+}